@@ -1,103 +1,167 @@
 package multicorecsv
 
 import (
-	"bytes"
-	"encoding/csv"
+	"context"
 	"io"
 )
 
+// Reader reads records from a CSV encoded source, parsing the records on
+// all available cores.  Use NewReader or NewReaderWithOptions.
 type Reader struct {
-	reader  *csv.Reader
-	done    chan error
-	toWrite chan [][]string
-	writer  *csv.Writer
-	toRead  chan []string
+	mcr *OldReader
 }
 
+// ReaderOptions configures a Reader.  The fields from Comma to ReuseRecord
+// have the same meaning as in encoding/csv.Reader, the rest are described
+// by the OldReader fields of the same name.
+type ReaderOptions struct {
+	Comma                rune // field delimiter, ',' when zero
+	Comment              rune
+	FieldsPerRecord      int
+	LazyQuotes           bool
+	TrimLeadingSpace     bool
+	ReuseRecord          bool
+	ChunkSize            int // the # of lines to hand to each goroutine -- default 50
+	UseHeader            bool
+	RequiredColumns      []string
+	Unordered            bool
+	MaxInFlight          int
+	Workers              int
+	ChunkBytes           int
+	AdaptiveChunks       bool
+	ErrorPolicy          ErrorPolicy
+	OnError              func(raw []byte, line int, err error) error
+	Rejects              io.Writer
+	RejectReport         io.Writer
+	DisableDecompression bool
+	Encoding             Encoding
+	Terminator           Terminator
+}
+
+// NewReader returns a new Reader that reads from rdr, handing size records
+// at a time to each parsing goroutine.  Quotes are handled lazily and records
+// may have a variable number of fields.  Must call Close when done.
 func NewReader(rdr io.Reader, size int) *Reader {
-	reader := csv.NewReader(rdr)
-	reader.LazyQuotes = true
-	reader.FieldsPerRecord = -1 // disabling this check
-	buf := &bytes.Buffer{}
-	r := &Reader{
-		reader:  reader,
-		done:    make(chan error),
-		toWrite: make(chan [][]string, size),
-		writer:  csv.NewWriter(buf),
-		toRead:  make(chan []string, size),
+	return NewReaderWithOptions(rdr, ReaderOptions{
+		LazyQuotes:      true,
+		FieldsPerRecord: -1, // disabling this check
+		ChunkSize:       size,
+	})
+}
+
+// NewReaderWithOptions returns a new Reader that reads from rdr configured by
+// opts.  Must call Close when done.
+func NewReaderWithOptions(rdr io.Reader, opts ReaderOptions) *Reader {
+	return NewReaderContext(context.Background(), rdr, opts)
+}
+
+// NewReaderContext is like NewReaderWithOptions, but when ctx is done all of
+// the reading and parsing goroutines are stopped and Read returns ctx.Err().
+func NewReaderContext(ctx context.Context, rdr io.Reader, opts ReaderOptions) *Reader {
+	if opts.ChunkSize < 1 {
+		opts.ChunkSize = 50 // sane default
+	}
+	// hide any Close method, closing rdr is up to the caller
+	return newReader(OldNewReaderContext(ctx, struct{ io.Reader }{rdr}, opts.ChunkSize), opts)
+}
+
+// NewReaderAt returns a new Reader that reads size bytes from r configured
+// by opts.  Ranges of r are read and parsed concurrently, see OldNewReaderAt
+// for the limits on quoting.  ChunkBytes sets the size of the ranges, 1 MiB
+// by default, ChunkSize and AdaptiveChunks don't apply.  Must call Close
+// when done.
+func NewReaderAt(r io.ReaderAt, size int64, opts ReaderOptions) *Reader {
+	return NewReaderAtContext(context.Background(), r, size, opts)
+}
+
+// NewReaderAtContext is like NewReaderAt, but when ctx is done all of the
+// reading and parsing goroutines are stopped and Read returns ctx.Err().
+func NewReaderAtContext(ctx context.Context, r io.ReaderAt, size int64, opts ReaderOptions) *Reader {
+	// hide any Close method, closing r is up to the caller
+	return newReader(OldNewReaderAtContext(ctx, struct{ io.ReaderAt }{r}, size), opts)
+}
+
+func newReader(mcr *OldReader, opts ReaderOptions) *Reader {
+	if opts.Comma != 0 {
+		mcr.Comma = opts.Comma
+	}
+	mcr.Comment = opts.Comment
+	mcr.FieldsPerRecord = opts.FieldsPerRecord
+	mcr.LazyQuotes = opts.LazyQuotes
+	mcr.TrimLeadingSpace = opts.TrimLeadingSpace
+	mcr.ReuseRecord = opts.ReuseRecord
+	mcr.UseHeader = opts.UseHeader
+	mcr.RequiredColumns = opts.RequiredColumns
+	mcr.Unordered = opts.Unordered
+	mcr.MaxInFlight = opts.MaxInFlight
+	mcr.Workers = opts.Workers
+	mcr.ChunkBytes = opts.ChunkBytes
+	mcr.AdaptiveChunks = opts.AdaptiveChunks
+	mcr.ErrorPolicy = opts.ErrorPolicy
+	mcr.OnError = opts.OnError
+	mcr.Rejects = opts.Rejects
+	mcr.RejectReport = opts.RejectReport
+	mcr.DisableDecompression = opts.DisableDecompression
+	mcr.Encoding = opts.Encoding
+	mcr.Terminator = opts.Terminator
+	return &Reader{
+		mcr: mcr,
 	}
-	go func() {
-		defer close(r.toRead)
-		// queue from the reader, then queue to the writer
-		for {
-			tw, ok := <-r.toWrite
-			if !ok {
-				return
-			}
-			for x := range tw {
-				select {
-				case r.toRead <- tw[x]:
-				case <-r.done:
-					return
-				}
-			}
-		}
-	}()
-	go func() {
-		// read and unstutter them!
-		defer func() {
-			close(r.toWrite)
-		}()
-		toSend := make([][]string, 0, size)
-		for {
-			line, err := reader.Read()
-			if err == io.EOF {
-				select {
-				case _, ok := <-r.done:
-					_ = ok // we don't use this but I need to receive a value for the compiler
-					// done processing
-				case r.toWrite <- toSend:
-				}
-				return
-			}
-			if err != nil {
-				select {
-				case _, ok := <-r.done:
-					_ = ok // we don't use this but I need to receive a value for the compiler
-					// done processing
-				case r.done <- err:
-					// error was sent, stop reading
-				}
-				return
-			}
-			toSend = append(toSend, line)
-			if len(toSend) == size {
-				select {
-				case _, ok := <-r.done:
-					_ = ok // we don't use this but I need to receive a value for the compiler
-					// done processing
-				case r.toWrite <- toSend:
-					toSend = make([][]string, 0, size)
-					// log.Printf("sent line toWrite")
-				}
-			}
-		}
-	}()
-	return r
 }
 
 // Close cleans up the resources created to read the file multicore style
 func (reader *Reader) Close() {
-	close(reader.done)
+	_ = reader.mcr.Close()
 }
 
-// Read returns only valid CSV data as read from the source and removes multilines and stutter
-// if there's an error all subsequent calls to Read will fail with the same error
+// Read returns only valid CSV data as read from the source, records are
+// returned in the order they appear in the source.
+// If there's an error all subsequent calls to Read will fail with the same error
 func (reader *Reader) Read() ([]string, error) {
-	select {
-	case line := <-reader.toRead:
-		return line, nil
-	case err := <-reader.done:
-		return nil, err
-	}
+	return reader.mcr.Read()
+}
+
+// ReadRecord is like Read, but returns the Record's line and, when
+// UseHeader is set, its fields can be found by their column.
+func (reader *Reader) ReadRecord() (Record, error) {
+	return reader.mcr.ReadRecord()
+}
+
+// Header returns the header, reading it if needed.  UseHeader must be set.
+func (reader *Reader) Header() ([]string, error) {
+	return reader.mcr.Header()
+}
+
+// ReadAll reads all the remaining records from the source.
+// A successful call returns err == nil, not err == EOF.
+func (reader *Reader) ReadAll() ([][]string, error) {
+	return reader.mcr.ReadAll()
+}
+
+// Stream returns a chan of []string representing a row in the CSV file.
+// See OldReader.Stream for the rules on draining the channels.
+func (reader *Reader) Stream() (chan []string, chan error) {
+	return reader.mcr.Stream()
+}
+
+// ReadBatch reads the records of a chunk at once, see OldReader.ReadBatch.
+func (reader *Reader) ReadBatch() ([][]string, error) {
+	return reader.mcr.ReadBatch()
+}
+
+// StreamBatches is like Stream, but sends the records a chunk at a time.
+func (reader *Reader) StreamBatches() (chan [][]string, chan error) {
+	return reader.mcr.StreamBatches()
+}
+
+// FieldPos returns the line and column where the field with the given index
+// starts in the record most recently returned, see OldReader.FieldPos.
+func (reader *Reader) FieldPos(field int) (line, column int) {
+	return reader.mcr.FieldPos(field)
+}
+
+// InputOffset returns the byte offset of the end of the record most
+// recently returned.
+func (reader *Reader) InputOffset() int64 {
+	return reader.mcr.InputOffset()
 }
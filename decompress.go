@@ -0,0 +1,331 @@
+package multicorecsv
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+type compression int
+
+const (
+	uncompressed compression = iota
+	gzipped
+	bgzipped // gzip made of blocks that say how long they are
+	bzipped
+	zstandard
+)
+
+const (
+	sniffSize      = 18 // enough to tell BGZF from gzip
+	bgzfHeaderSize = 18
+	bgzfBlockData  = 0xff00 // the most data Writer puts in a block, so that it compresses to under 64 KiB
+)
+
+// maxZstdFrame is the most of a zstd frame read into memory to be decoded on
+// its own, a var so that the tests can lower it
+var maxZstdFrame = 16 << 20
+
+// bgzfEOF is the empty block that ends BGZF output
+var bgzfEOF = []byte{
+	0x1f, 0x8b, 0x08, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff, 0x06, 0x00, 0x42, 0x43, 0x02, 0x00,
+	0x1b, 0x00, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+}
+
+var (
+	zstdMagic        = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	errFrameTooLarge = errors.New("multicorecsv: zstd frame too large to decode on its own")
+	errTruncatedZstd = errors.New("multicorecsv: truncated zstd frame")
+)
+
+// sniff returns what compression, if any, the input starting with head has
+func sniff(head []byte) compression {
+	switch {
+	case len(head) >= 3 && head[0] == 0x1f && head[1] == 0x8b && head[2] == 8:
+		if len(head) >= bgzfHeaderSize && head[3]&4 != 0 && head[12] == 'B' && head[13] == 'C' && head[14] == 2 && head[15] == 0 {
+			return bgzipped
+		}
+		return gzipped
+	case len(head) >= 10 && bytes.HasPrefix(head, []byte("BZh")) && head[3] >= '1' && head[3] <= '9' &&
+		bytes.Equal(head[4:10], []byte{0x31, 0x41, 0x59, 0x26, 0x53, 0x59}):
+		return bzipped
+	case bytes.HasPrefix(head, zstdMagic) || isSkippableFrame(head):
+		return zstandard
+	}
+	return uncompressed
+}
+
+// isSkippableFrame reports whether head starts with the magic number of a
+// zstd frame that holds no data
+func isSkippableFrame(head []byte) bool {
+	return len(head) >= 4 && head[0]&0xf0 == 0x50 && bytes.Equal(head[1:4], []byte{0x2a, 0x4d, 0x18})
+}
+
+// decompress returns the input of r, decompressed if it's compressed and
+// DisableDecompression isn't set
+func (mcr *OldReader) decompress(r *bufio.Reader) (io.Reader, error) {
+	if mcr.DisableDecompression {
+		return r, nil
+	}
+	head, _ := r.Peek(sniffSize) // short input is an error for later
+	switch sniff(head) {
+	case gzipped:
+		return mcr.newGzipReader(r), nil
+	case bgzipped:
+		return mcr.newBGZFReader(r), nil
+	case bzipped:
+		return bzip2.NewReader(r), nil
+	case zstandard:
+		return mcr.newZstdReader(r)
+	}
+	return r, nil
+}
+
+// decodedBlock is a decompressed block, or why it couldn't be
+type decodedBlock struct {
+	data []byte
+	rest io.Reader // when set, the rest of the input is read from it instead
+	err  error
+}
+
+// blockReader decompresses input made of blocks that are compressed on
+// their own, BGZF blocks or zstd frames, concurrently and reads them back in
+// order
+type blockReader struct {
+	results chan chan decodedBlock // the result of each block, in order
+	cancel  chan struct{}
+	current []byte
+	rest    io.Reader
+	err     error
+}
+
+// newBlockReader starts Workers goroutines decoding the blocks returned by
+// next.  next returns io.EOF after the last block.  When the input can't be
+// split into blocks any further, next returns a reader for the rest of it
+// instead of a block.
+func (mcr *OldReader) newBlockReader(next func() ([]byte, io.Reader, error), decode func([]byte) ([]byte, error)) *blockReader {
+	n := workers(mcr.Workers)
+	br := &blockReader{
+		results: make(chan chan decodedBlock, 2*n),
+		cancel:  mcr.cancel,
+	}
+	type job struct {
+		block  []byte
+		result chan decodedBlock
+	}
+	jobs := make(chan job)
+	for i := 0; i < n; i++ {
+		go func() {
+			for j := range jobs {
+				data, err := decode(j.block)
+				j.result <- decodedBlock{data: data, err: err}
+			}
+		}()
+	}
+	go func() {
+		defer close(jobs)
+		defer close(br.results)
+		for {
+			block, rest, err := next()
+			if err == io.EOF {
+				return
+			}
+			result := make(chan decodedBlock, 1)
+			if err != nil || rest != nil {
+				result <- decodedBlock{rest: rest, err: err}
+			}
+			select {
+			case br.results <- result:
+			case <-mcr.cancel:
+				return
+			}
+			if err != nil || rest != nil {
+				return
+			}
+			select {
+			case jobs <- job{block: block, result: result}:
+			case <-mcr.cancel:
+				return
+			}
+		}
+	}()
+	return br
+}
+
+func (br *blockReader) Read(p []byte) (int, error) {
+	for len(br.current) == 0 {
+		if br.rest != nil {
+			return br.rest.Read(p)
+		}
+		if br.err != nil {
+			return 0, br.err
+		}
+		var result chan decodedBlock
+		var ok bool
+		select {
+		case result, ok = <-br.results:
+		case <-br.cancel:
+			ok = false
+		}
+		if !ok {
+			br.err = io.EOF
+			continue
+		}
+		select {
+		case block := <-result:
+			br.current, br.rest, br.err = block.data, block.rest, block.err
+		case <-br.cancel:
+			br.err = io.EOF
+		}
+	}
+	n := copy(p, br.current)
+	br.current = br.current[n:]
+	return n, nil
+}
+
+// newBGZFReader inflates the blocks of BGZF input concurrently
+func (mcr *OldReader) newBGZFReader(r *bufio.Reader) *blockReader {
+	return mcr.newBlockReader(func() ([]byte, io.Reader, error) {
+		block, err := readBGZFBlock(r)
+		return block, nil, err
+	}, inflateBlock)
+}
+
+// readBGZFBlock reads the next compressed block from r
+func readBGZFBlock(r io.Reader) ([]byte, error) {
+	header := make([]byte, bgzfHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errors.New("multicorecsv: truncated BGZF block")
+		}
+		return nil, err
+	}
+	if sniff(header) != bgzipped {
+		return nil, errors.New("multicorecsv: gzip member without a BGZF block size")
+	}
+	size := int(header[16]) | int(header[17])<<8 + 1
+	if size < bgzfHeaderSize {
+		return nil, errors.New("multicorecsv: bad BGZF block size")
+	}
+	block := make([]byte, size)
+	copy(block, header)
+	if _, err := io.ReadFull(r, block[bgzfHeaderSize:]); err != nil {
+		return nil, errors.New("multicorecsv: truncated BGZF block")
+	}
+	return block, nil
+}
+
+func inflateBlock(block []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(block))
+	if err != nil {
+		return nil, err
+	}
+	zr.Multistream(false)
+	return io.ReadAll(zr)
+}
+
+// newZstdReader decodes the frames of zstd input concurrently.  Once a
+// frame is too large to hold in memory, as when the whole input is one
+// frame, the rest of the input is decoded as a stream.
+func (mcr *OldReader) newZstdReader(r *bufio.Reader) (io.Reader, error) {
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(workers(mcr.Workers)))
+	if err != nil {
+		return nil, err
+	}
+	return mcr.newBlockReader(func() ([]byte, io.Reader, error) {
+		frame, err := readZstdFrame(r)
+		if err == errFrameTooLarge {
+			// with a concurrency of 1 the stream is decoded without goroutines
+			stream, err := zstd.NewReader(io.MultiReader(bytes.NewReader(frame), r), zstd.WithDecoderConcurrency(1))
+			return nil, stream, err
+		}
+		return frame, nil, err
+	}, func(frame []byte) ([]byte, error) {
+		return dec.DecodeAll(frame, nil)
+	}), nil
+}
+
+// readZstdFrame reads the next frame from r, skipping any skippable frames.
+// A frame is only read up to maxZstdFrame, then what was read is returned
+// along with errFrameTooLarge.
+func readZstdFrame(r *bufio.Reader) ([]byte, error) {
+	read := func(frame []byte, n int) ([]byte, error) {
+		start := len(frame)
+		frame = append(frame, make([]byte, n)...)
+		if _, err := io.ReadFull(r, frame[start:]); err != nil {
+			return nil, errTruncatedZstd
+		}
+		return frame, nil
+	}
+	for {
+		magic := make([]byte, 4)
+		if _, err := io.ReadFull(r, magic); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				err = errTruncatedZstd
+			}
+			return nil, err // io.EOF after the last frame
+		}
+		if isSkippableFrame(magic) {
+			size, err := read(nil, 4)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := r.Discard(int(binary.LittleEndian.Uint32(size))); err != nil {
+				return nil, errTruncatedZstd
+			}
+			continue
+		}
+		if !bytes.Equal(magic, zstdMagic) {
+			return nil, errors.New("multicorecsv: data after the zstd frames isn't a frame")
+		}
+		frame, err := read(magic, 1)
+		if err != nil {
+			return nil, err
+		}
+		descriptor := frame[4]
+		headerSize := [4]int{0, 1, 2, 4}[descriptor&3] // the dictionary ID
+		if descriptor&0x20 == 0 {
+			headerSize++ // the window descriptor
+		}
+		switch fcs := descriptor >> 6; {
+		case fcs == 0 && descriptor&0x20 != 0:
+			headerSize++
+		case fcs > 0:
+			headerSize += 1 << fcs
+		}
+		if frame, err = read(frame, headerSize); err != nil {
+			return nil, err
+		}
+		for last := false; !last; {
+			start := len(frame)
+			if frame, err = read(frame, 3); err != nil {
+				return nil, err
+			}
+			header := int(frame[start]) | int(frame[start+1])<<8 | int(frame[start+2])<<16
+			last = header&1 != 0
+			size := header >> 3
+			switch header >> 1 & 3 {
+			case 1:
+				size = 1 // RLE blocks hold the byte to repeat
+			case 3:
+				return nil, errors.New("multicorecsv: bad zstd block type")
+			}
+			if frame, err = read(frame, size); err != nil {
+				return nil, err
+			}
+			if !last && len(frame) > maxZstdFrame {
+				return frame, errFrameTooLarge
+			}
+		}
+		if descriptor&4 != 0 {
+			return read(frame, 4) // the checksum
+		}
+		return frame, nil
+	}
+}
@@ -0,0 +1,211 @@
+package multicorecsv
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// An Encoding is the character encoding of the input or output.  Records are
+// always UTF-8 strings.
+type Encoding int
+
+const (
+	UTF8        Encoding = iota
+	UTF16LE              // UTF-16, little endian
+	UTF16BE              // UTF-16, big endian
+	Windows1252          // Windows code page 1252, as used by Excel
+	Latin1               // ISO-8859-1
+)
+
+var (
+	utf8BOM    = []byte{0xef, 0xbb, 0xbf}
+	utf16LEBOM = []byte{0xff, 0xfe}
+	utf16BEBOM = []byte{0xfe, 0xff}
+)
+
+// windows1252 has the runes for 0x80 to 0x9f, the rest of the bytes are the
+// same as in Latin1.  The bytes it leaves undefined are C1 controls, like
+// the WHATWG says.
+var windows1252 = [32]rune{
+	0x20ac, 0x0081, 0x201a, 0x0192, 0x201e, 0x2026, 0x2020, 0x2021,
+	0x02c6, 0x2030, 0x0160, 0x2039, 0x0152, 0x008d, 0x017d, 0x008f,
+	0x0090, 0x2018, 0x2019, 0x201c, 0x201d, 0x2022, 0x2013, 0x2014,
+	0x02dc, 0x2122, 0x0161, 0x203a, 0x0153, 0x009d, 0x017e, 0x0178,
+}
+
+// fromWindows1252 is the reverse of windows1252
+var fromWindows1252 = func() map[rune]byte {
+	m := make(map[rune]byte, len(windows1252))
+	for i, r := range windows1252 {
+		m[r] = byte(0x80 + i)
+	}
+	return m
+}()
+
+// singleByte reports whether e is transcoded a record at a time by the
+// parsing or encoding goroutines.  UTF-16 isn't, as newlines and quotes
+// can't be found without decoding it.
+func (e Encoding) singleByte() bool {
+	return e == Windows1252 || e == Latin1
+}
+
+// appendDecoded appends src, encoded with the single byte encoding e, to
+// dst as UTF-8
+func appendDecoded(dst, src []byte, e Encoding) []byte {
+	for _, b := range src {
+		switch {
+		case b < utf8.RuneSelf:
+			dst = append(dst, b)
+		case e == Windows1252 && b < 0xa0:
+			dst = utf8.AppendRune(dst, windows1252[b-0x80])
+		default:
+			dst = utf8.AppendRune(dst, rune(b))
+		}
+	}
+	return dst
+}
+
+// appendEncoded appends the UTF-8 src to dst encoded with e.  Runes that e
+// can't encode are written as '?'.
+func appendEncoded(dst, src []byte, e Encoding) []byte {
+	for len(src) > 0 {
+		r, size := utf8.DecodeRune(src)
+		src = src[size:]
+		switch e {
+		case UTF16LE, UTF16BE:
+			units := []uint16{uint16(r)}
+			if r1, r2 := utf16.EncodeRune(r); r1 != utf8.RuneError {
+				units = []uint16{uint16(r1), uint16(r2)}
+			}
+			for _, u := range units {
+				if e == UTF16LE {
+					dst = append(dst, byte(u), byte(u>>8))
+				} else {
+					dst = append(dst, byte(u>>8), byte(u))
+				}
+			}
+		case Windows1252:
+			if b, ok := fromWindows1252[r]; ok {
+				dst = append(dst, b)
+			} else if r < 0x80 || (r >= 0xa0 && r <= 0xff) {
+				dst = append(dst, byte(r))
+			} else {
+				dst = append(dst, '?')
+			}
+		case Latin1:
+			if r <= 0xff {
+				dst = append(dst, byte(r))
+			} else {
+				dst = append(dst, '?')
+			}
+		default:
+			dst = utf8.AppendRune(dst, r)
+		}
+	}
+	return dst
+}
+
+// writeRecord writes raw, a record as it was in the input, to buf as UTF-8
+// with the line endings encoding/csv understands.
+func (mcr *OldReader) writeRecord(buf *bytes.Buffer, raw []byte) {
+	start := buf.Len()
+	if mcr.Encoding.singleByte() {
+		_, _ = buf.Write(appendDecoded(buf.AvailableBuffer(), raw, mcr.Encoding))
+	} else {
+		_, _ = buf.Write(raw)
+	}
+	if mcr.Terminator != LFTerminator {
+		normalizeCR(buf.Bytes()[start:], mcr.Terminator == CRTerminator)
+	}
+}
+
+// decodeInput strips any byte order mark from the start of r and returns
+// the input as UTF-8 when it's UTF-16.  A UTF-16 mark overrides Encoding if
+// it's UTF8.  The length of a UTF-8 mark is returned too, offsets in UTF-16
+// input count the bytes after transcoding.
+func (mcr *OldReader) decodeInput(r *bufio.Reader) (io.Reader, int) {
+	head, _ := r.Peek(len(utf8BOM))
+	enc := mcr.Encoding
+	skip := 0
+	switch {
+	case enc == UTF8 && bytes.HasPrefix(head, utf8BOM):
+		skip = len(utf8BOM)
+	case (enc == UTF8 || enc == UTF16LE) && bytes.HasPrefix(head, utf16LEBOM):
+		enc, skip = UTF16LE, len(utf16LEBOM)
+	case (enc == UTF8 || enc == UTF16BE) && bytes.HasPrefix(head, utf16BEBOM):
+		enc, skip = UTF16BE, len(utf16BEBOM)
+	}
+	_, _ = r.Discard(skip)
+	if enc == UTF16LE || enc == UTF16BE {
+		mcr.transcoded = enc // set before any chunk is sent
+		return &utf16Reader{r: r, bigEndian: enc == UTF16BE}, 0
+	}
+	return r, skip
+}
+
+// isUTF16 reports whether input starting with head is read as UTF-16
+func (mcr *OldReader) isUTF16(head []byte) bool {
+	switch mcr.Encoding {
+	case UTF16LE, UTF16BE:
+		return true
+	case UTF8:
+		return bytes.HasPrefix(head, utf16LEBOM) || bytes.HasPrefix(head, utf16BEBOM)
+	}
+	return false
+}
+
+// utf16Reader reads UTF-16 input as UTF-8
+type utf16Reader struct {
+	r         io.Reader
+	bigEndian bool
+	buf       [4096]byte
+	n         int    // the bytes at the start of buf not decoded yet
+	out       []byte // decoded, but not read yet
+	err       error
+}
+
+func (u *utf16Reader) unit(i int) rune {
+	if u.bigEndian {
+		return rune(u.buf[i])<<8 | rune(u.buf[i+1])
+	}
+	return rune(u.buf[i+1])<<8 | rune(u.buf[i])
+}
+
+func (u *utf16Reader) Read(p []byte) (int, error) {
+	for len(u.out) == 0 {
+		if u.err != nil {
+			return 0, u.err
+		}
+		n, err := u.r.Read(u.buf[u.n:])
+		u.n += n
+		u.err = err
+		u.out = u.out[:0]
+		i := 0
+		for ; i+1 < u.n; i += 2 {
+			r := u.unit(i)
+			if r >= 0xd800 && r < 0xdc00 { // the first of a surrogate pair
+				if i+3 >= u.n && err == nil {
+					break // the second is still to be read
+				}
+				if i+3 < u.n {
+					if pair := utf16.DecodeRune(r, u.unit(i+2)); pair != utf8.RuneError {
+						r = pair
+						i += 2
+					}
+				}
+			}
+			u.out = utf8.AppendRune(u.out, r) // lone surrogates become utf8.RuneError
+		}
+		if err != nil && i < u.n {
+			u.out = utf8.AppendRune(u.out, utf8.RuneError) // an odd byte at the end
+			i = u.n
+		}
+		u.n = copy(u.buf[:], u.buf[i:u.n])
+	}
+	n := copy(p, u.out)
+	u.out = u.out[n:]
+	return n, nil
+}
@@ -1,3 +1,5 @@
 module github.com/mzimmerman/multicorecsv
 
-go 1.21.3
+go 1.22
+
+require github.com/klauspost/compress v1.18.0
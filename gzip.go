@@ -0,0 +1,393 @@
+package multicorecsv
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	gzipSegmentSize = 512 << 10 // compressed bytes read at a time, a run of members is tried from each
+	gzipPieceSize   = 64 << 10  // the most output a run sends at once
+	gzipRunAhead    = 64        // pieces a run can inflate before they're read
+)
+
+var errRunDropped = errors.New("multicorecsv: gzip run isn't needed")
+
+// gzipSegment is a piece of the compressed input.  The segments are linked,
+// once no run is reading one it's garbage collected.
+type gzipSegment struct {
+	data  []byte
+	start int64        // the offset of data in the input
+	index int64        // the number of segments before this one
+	next  *gzipSegment // set before done is closed, nil at the end of the input
+	err   error        // set before done is closed when the input can't be read
+	done  chan struct{}
+}
+
+// gzipReader inflates multi-member gzip input concurrently.  The members
+// can't be found without inflating the ones before them, so a run of members
+// is inflated from each segment of the input, starting at the first thing
+// that looks like a gzip header.  The runs are read in order, a run is only
+// used when the one before it ended where it starts, otherwise the members
+// in between are inflated as they're read.
+type gzipReader struct {
+	r      io.Reader
+	ahead  int64        // the segments read past the one the current run is reading
+	base   atomic.Int64 // the index of the segment the current run is reading
+	moved  chan struct{}
+	cancel chan struct{}
+
+	lock    sync.Mutex
+	pending []*gzipRun // the runs not reached yet, in order
+	done    bool       // set once every run has been added to pending
+	added   chan struct{}
+
+	current *gzipRun
+	piece   []byte
+	pos     int64          // where the next run has to start
+	tail    *segmentReader // reads from pos once a run has ended
+	err     error
+}
+
+// gzipRun inflates members from start until one ends at or after until.
+type gzipRun struct {
+	gr      *gzipReader
+	index   int64 // the index of the segment start is in
+	start   int64
+	until   int64
+	sr      *segmentReader
+	out     chan []byte // closed once the run ends
+	end     int64       // where the run ended, set before out is closed
+	err     error       // why the run ended early, io.EOF at the end of the input, set before out is closed
+	current atomic.Bool // set once the run is being read, the input is then read ahead of it
+	drop    chan struct{}
+}
+
+// segmentReader reads the input from a point in a segment on.  It's a
+// flate.Reader so that gzip.Reader reads no further than the end of a member.
+type segmentReader struct {
+	run   *gzipRun
+	seg   *gzipSegment
+	pos   int
+	index atomic.Int64 // seg.index, for the gzipReader
+}
+
+func (mcr *OldReader) newGzipReader(r io.Reader) *gzipReader {
+	gr := &gzipReader{
+		r:      r,
+		ahead:  int64(workers(mcr.Workers)),
+		moved:  make(chan struct{}, 1),
+		cancel: mcr.cancel,
+		added:  make(chan struct{}, 1),
+	}
+	go gr.readSegments()
+	return gr
+}
+
+// readSegments reads the input a segment at a time, starting a run in each,
+// as long as they're no more than ahead of the current run
+func (gr *gzipReader) readSegments() {
+	defer func() {
+		gr.lock.Lock()
+		gr.done = true
+		gr.lock.Unlock()
+		signal(gr.added)
+	}()
+	var last *gzipSegment
+	var start int64
+	for index := int64(0); ; index++ {
+		for index > gr.base.Load()+gr.ahead {
+			select {
+			case <-gr.moved:
+			case <-gr.cancel:
+				return
+			}
+		}
+		data := make([]byte, gzipSegmentSize)
+		n, err := io.ReadFull(gr.r, data)
+		seg := &gzipSegment{
+			data:  data[:n],
+			start: start,
+			index: index,
+			done:  make(chan struct{}),
+		}
+		start += int64(n)
+		if last != nil {
+			last.next = seg
+			close(last.done)
+		}
+		last = seg
+		gr.addRun(seg)
+		if err != nil {
+			if err != io.EOF && err != io.ErrUnexpectedEOF {
+				seg.err = err
+			}
+			close(seg.done) // the input ends with seg
+			return
+		}
+	}
+}
+
+// addRun starts a run at the first gzip header in seg, the first segment
+// always has one at its start.  Runs before the one the current run is
+// reading are dropped, they can't be needed.
+func (gr *gzipReader) addRun(seg *gzipSegment) {
+	at := 0
+	if seg.index > 0 {
+		if at = findGzipHeader(seg.data); at < 0 {
+			return
+		}
+	}
+	run := &gzipRun{
+		gr:    gr,
+		index: seg.index,
+		start: seg.start + int64(at),
+		until: seg.start + int64(len(seg.data)),
+		out:   make(chan []byte, gzipRunAhead),
+		drop:  make(chan struct{}),
+	}
+	run.sr = &segmentReader{run: run, seg: seg, pos: at}
+	run.sr.index.Store(seg.index)
+	go run.inflate()
+	gr.lock.Lock()
+	base := gr.base.Load()
+	for len(gr.pending) > 0 && gr.pending[0].index < base {
+		close(gr.pending[0].drop)
+		gr.pending = gr.pending[1:]
+	}
+	gr.pending = append(gr.pending, run)
+	gr.lock.Unlock()
+	signal(gr.added)
+}
+
+// findGzipHeader returns where the first thing that looks like a gzip header
+// is in data, or -1.  Only the fixed fields of the header are checked.
+func findGzipHeader(data []byte) int {
+	for at := 0; ; {
+		i := bytes.Index(data[at:], []byte{0x1f, 0x8b, 8})
+		if i < 0 {
+			return -1
+		}
+		h := data[at+i:]
+		if len(h) < 10 {
+			return -1
+		}
+		if h[3]&0xe0 == 0 && (h[8] == 0 || h[8] == 2 || h[8] == 4) && (h[9] <= 13 || h[9] == 255) {
+			return at + i
+		}
+		at += i + 1
+	}
+}
+
+// signal wakes up whoever waits on c, without waiting itself
+func signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// setBase lets the input be read further ahead when the current run moves
+// on to the segment with the given index
+func (gr *gzipReader) setBase(index int64) {
+	for {
+		base := gr.base.Load()
+		if index <= base {
+			return
+		}
+		if gr.base.CompareAndSwap(base, index) {
+			signal(gr.moved)
+			return
+		}
+	}
+}
+
+func (gr *gzipReader) Read(p []byte) (int, error) {
+	for len(gr.piece) == 0 {
+		if gr.err != nil {
+			return 0, gr.err
+		}
+		if gr.current == nil {
+			gr.nextRun()
+			continue
+		}
+		var piece []byte
+		var ok bool
+		select {
+		case piece, ok = <-gr.current.out:
+		case <-gr.cancel:
+			gr.err = io.EOF
+			continue
+		}
+		if ok {
+			gr.piece = piece
+			continue
+		}
+		run := gr.current
+		gr.current = nil
+		if run.err != nil {
+			gr.err = run.err
+			continue
+		}
+		gr.pos, gr.tail = run.end, run.sr
+	}
+	n := copy(p, gr.piece)
+	gr.piece = gr.piece[n:]
+	return n, nil
+}
+
+// nextRun makes the run starting at pos the current one.  Without one, a run
+// is started from pos to inflate the members up to the next pending run or
+// the end of the segment, whichever comes first.
+func (gr *gzipReader) nextRun() {
+	for {
+		gr.lock.Lock()
+		for len(gr.pending) > 0 && gr.pending[0].start < gr.pos {
+			close(gr.pending[0].drop)
+			gr.pending = gr.pending[1:]
+		}
+		var run *gzipRun
+		if len(gr.pending) > 0 {
+			run = gr.pending[0]
+			if run.start == gr.pos {
+				gr.pending = gr.pending[1:]
+			}
+		}
+		done := gr.done
+		gr.lock.Unlock()
+		switch {
+		case run != nil && run.start == gr.pos:
+			gr.setCurrent(run)
+			return
+		case gr.tail == nil && done:
+			gr.err = io.EOF // cancelled before the first run
+			return
+		case gr.tail == nil:
+			// the first run starts at 0, wait for it
+			select {
+			case <-gr.added:
+			case <-gr.cancel:
+				gr.err = io.EOF
+				return
+			}
+			continue
+		}
+		sr := gr.tail
+		until := sr.seg.start + int64(len(sr.seg.data))
+		if run != nil && run.start < until {
+			until = run.start
+		}
+		run = &gzipRun{
+			gr:    gr,
+			index: sr.seg.index,
+			start: gr.pos,
+			until: until,
+			sr:    sr,
+			out:   make(chan []byte, gzipRunAhead),
+			drop:  make(chan struct{}),
+		}
+		sr.run = run
+		go run.inflate()
+		gr.setCurrent(run)
+		return
+	}
+}
+
+func (gr *gzipReader) setCurrent(run *gzipRun) {
+	gr.current = run
+	run.current.Store(true)
+	gr.setBase(run.sr.index.Load())
+}
+
+// inflate sends the output of the members from start on, until one ends at
+// or after until
+func (run *gzipRun) inflate() {
+	defer close(run.out)
+	var zr gzip.Reader
+	for first := true; ; first = false {
+		run.end = run.sr.offset()
+		if !first && run.end >= run.until {
+			return
+		}
+		if err := zr.Reset(run.sr); err != nil {
+			run.err = err // io.EOF at the end of the input
+			return
+		}
+		zr.Multistream(false)
+		for err := error(nil); err != io.EOF; {
+			piece := make([]byte, gzipPieceSize)
+			n := 0
+			for n < len(piece) && err == nil {
+				var m int
+				m, err = zr.Read(piece[n:])
+				n += m
+			}
+			if n > 0 {
+				select {
+				case run.out <- piece[:n]:
+				case <-run.drop:
+					run.err = errRunDropped
+					return
+				case <-run.gr.cancel:
+					run.err = errRunDropped
+					return
+				}
+			}
+			if err != nil && err != io.EOF {
+				run.err = err
+				return
+			}
+		}
+	}
+}
+
+func (sr *segmentReader) offset() int64 {
+	return sr.seg.start + int64(sr.pos)
+}
+
+// fill waits for more input when the segment has been read
+func (sr *segmentReader) fill() error {
+	for sr.pos == len(sr.seg.data) {
+		select {
+		case <-sr.seg.done:
+		case <-sr.run.drop:
+			return errRunDropped
+		case <-sr.run.gr.cancel:
+			return errRunDropped
+		}
+		if sr.seg.next == nil {
+			if sr.seg.err != nil {
+				return sr.seg.err
+			}
+			return io.EOF
+		}
+		sr.seg, sr.pos = sr.seg.next, 0
+		sr.index.Store(sr.seg.index)
+		if sr.run.current.Load() {
+			sr.run.gr.setBase(sr.seg.index)
+		}
+	}
+	return nil
+}
+
+func (sr *segmentReader) Read(p []byte) (int, error) {
+	if err := sr.fill(); err != nil {
+		return 0, err
+	}
+	n := copy(p, sr.seg.data[sr.pos:])
+	sr.pos += n
+	return n, nil
+}
+
+func (sr *segmentReader) ReadByte() (byte, error) {
+	if err := sr.fill(); err != nil {
+		return 0, err
+	}
+	b := sr.seg.data[sr.pos]
+	sr.pos++
+	return b, nil
+}
@@ -0,0 +1,134 @@
+package multicorecsv
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"io"
+)
+
+// These are the errors returned in a *RecordError when the header is wrong.
+var (
+	ErrDuplicateColumn = errors.New("duplicate column")
+	ErrMissingColumn   = errors.New("missing required column")
+)
+
+// A Record is a record along with where it was in the input.  When it was
+// read with UseHeader set, its fields can be found by the name of their
+// column.
+type Record struct {
+	Fields  []string
+	Line    int // the line where the record starts
+	columns map[string]int
+}
+
+// Lookup returns the field in the named column.  ok is false when there's no
+// such column or the record is too short to have it.
+func (r Record) Lookup(name string) (field string, ok bool) {
+	column, ok := r.columns[name]
+	if !ok || column >= len(r.Fields) {
+		return "", false
+	}
+	return r.Fields[column], true
+}
+
+// Get returns the field in the named column, or "" if there isn't one.
+func (r Record) Get(name string) string {
+	field, _ := r.Lookup(name)
+	return field
+}
+
+// Map returns the fields of the record by the name of their column.
+func (r Record) Map() map[string]string {
+	m := make(map[string]string, len(r.columns))
+	for name, column := range r.columns {
+		if column < len(r.Fields) {
+			m[name] = r.Fields[column]
+		}
+	}
+	return m
+}
+
+// readHeader parses and checks the header, it's only done by startReading so
+// that it's known before any of the records are handed to the parsing
+// goroutines.
+func (mcr *OldReader) readHeader(raw csvLine) error {
+	line := raw.line
+	var buf bytes.Buffer
+	mcr.writeRecord(&buf, raw.data)
+	header, err := mcr.newCSVReader(&buf).Read()
+	if err != nil {
+		if pe, ok := err.(*csv.ParseError); ok {
+			perr := newParseError(pe, line, raw.offset)
+			perr.Record = 1
+			return perr
+		}
+		return err
+	}
+	if err := mcr.checkFieldCount(sliceLine{data: header, line: line, offset: raw.offset}, 1); err != nil {
+		return err
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		if _, ok := columns[name]; ok {
+			return &RecordError{Line: line, Column: name, Err: ErrDuplicateColumn}
+		}
+		columns[name] = i
+	}
+	for _, name := range mcr.RequiredColumns {
+		if _, ok := columns[name]; !ok {
+			return &RecordError{Line: line, Column: name, Err: ErrMissingColumn}
+		}
+	}
+	mcr.header = append([]string(nil), header...) // don't keep a reused record
+	mcr.columns = columns
+	close(mcr.headerDone)
+	return nil
+}
+
+// headerNotFound is deferred by the goroutine splitting the input, if it
+// didn't find the header err is why
+func (mcr *OldReader) headerNotFound(err error) {
+	if mcr.header != nil {
+		return
+	}
+	mcr.headerErr = err
+	if err == nil {
+		mcr.headerErr = io.EOF
+	}
+	close(mcr.headerDone)
+}
+
+// Header returns the header, reading it if needed.  UseHeader must be set.
+// If the header can't be read, Header returns the error Read would, which is
+// io.EOF when the input has no records at all.
+func (mcr *OldReader) Header() ([]string, error) {
+	if !mcr.UseHeader {
+		return nil, errors.New("multicorecsv: Header called without UseHeader")
+	}
+	mcr.start()
+	select {
+	case <-mcr.headerDone:
+	case <-mcr.ctx.Done():
+		return nil, mcr.ctx.Err()
+	}
+	if mcr.header == nil {
+		return nil, mcr.headerErr
+	}
+	return append([]string(nil), mcr.header...), nil
+}
+
+// ReadRecord is like Read, but returns a Record so that the fields can be
+// found by their column when UseHeader is set.  The Record's Line tells
+// where it was when reading with Unordered.
+func (mcr *OldReader) ReadRecord() (Record, error) {
+	line, err := mcr.next()
+	if line.data == nil {
+		return Record{}, err
+	}
+	return Record{
+		Fields:  line.data,
+		Line:    line.line,
+		columns: mcr.columns,
+	}, err
+}
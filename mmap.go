@@ -0,0 +1,42 @@
+package multicorecsv
+
+import "os"
+
+// Open returns a new Reader that reads the file at path configured by opts.
+// The file is split into ranges like NewReaderAt does, but where it's
+// supported the file is memory mapped and the ranges are parsed straight
+// from the mapping instead of being copied.  If the file can't be mapped,
+// it's read like NewReaderAt reads it instead.  The same limits on quoting
+// apply.  Anything but a regular file with a size, such as a named pipe, is
+// read as a stream like NewReaderWithOptions reads it.  Must call Close when
+// done, it unmaps and closes the file once the goroutines are done with it,
+// after that Read returns ErrReaderClosed.
+func Open(path string, opts ReaderOptions) (*Reader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() || fi.Size() == 0 {
+		// a pipe or device has no size to split by, nor does a file in /proc
+		return NewReaderWithOptions(f, opts), nil
+	}
+	r := newReader(OldNewReaderAt(f, fi.Size()), opts)
+	data, err := mmap(f, fi.Size())
+	if err != nil || data == nil {
+		return r, nil // read the file instead
+	}
+	r.mcr.mapped = data
+	r.mcr.release = func() error {
+		err := munmap(data)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	}
+	return r, nil
+}
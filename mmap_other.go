@@ -0,0 +1,14 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package multicorecsv
+
+import "os"
+
+// mmap isn't supported, Open reads the file instead
+func mmap(f *os.File, size int64) ([]byte, error) {
+	return nil, nil
+}
+
+func munmap(data []byte) error {
+	return nil
+}
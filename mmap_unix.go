@@ -0,0 +1,20 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package multicorecsv
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+func mmap(f *os.File, size int64) ([]byte, error) {
+	if int64(int(size)) != size {
+		return nil, errors.New("multicorecsv: file is too large to map")
+	}
+	return syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func munmap(data []byte) error {
+	return syscall.Munmap(data)
+}
@@ -0,0 +1,35 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package multicorecsv
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func TestOpenFIFO(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fifo.csv")
+	if err := syscall.Mkfifo(path, 0o600); err != nil {
+		t.Skipf("can't make a named pipe - %v", err)
+	}
+	go func() {
+		f, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			return // Open failed, reported below
+		}
+		f.WriteString("a,b\n1,2\n")
+		f.Close()
+	}()
+	r, err := Open(path, ReaderOptions{})
+	if err != nil {
+		t.Fatalf("Error opening %s - %v", path, err)
+	}
+	defer r.Close()
+	got, err := r.ReadAll()
+	if err != nil || !reflect.DeepEqual(got, [][]string{{"a", "b"}, {"1", "2"}}) {
+		t.Errorf("ReadAll returned %q, %v", got, err)
+	}
+}
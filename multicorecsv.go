@@ -3,42 +3,219 @@ package multicorecsv
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/csv"
+	"errors"
+	"fmt"
 	"io"
 	"runtime"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// ErrReaderStarted is returned by NewDecoder and Pipe when the Reader has
+// already been read from, or its Header read, as the parsing goroutines are
+// running without them.
+var ErrReaderStarted = errors.New("multicorecsv: Reader was already read from")
+
+// ErrReaderClosed is returned by Read once Close has unmapped the file that a
+// Reader from Open was reading.
+var ErrReaderClosed = errors.New("multicorecsv: Reader is closed")
+
 type csvLine struct {
-	data []byte
-	num  int
+	data   []byte // nil when the line isn't to be parsed, such as the header
+	line   int    // the line where the record starts
+	offset int64  // the byte offset where the record starts
 }
 
 type sliceLine struct {
-	data []string
-	num  int
+	data   []string
+	raw    []byte // the record before it was parsed, for FieldPos
+	line   int
+	offset int64
+	value  interface{} // set by transform
+	err    error       // set when transform fails or the record can't be parsed
+	fatal  bool        // set when err stops the reading
+	stop   bool        // set when err isn't about the record, it stops the reading whatever the ErrorPolicy
+}
+
+// rawChunk is handed to a parsing goroutine, the lines are either split
+// already or returned by load
+type rawChunk struct {
+	num   int
+	lines []csvLine
+	load  func() ([]csvLine, error)
+}
+
+type parsedChunk struct {
+	num   int
+	lines []sliceLine
+}
+
+// A RecordError is returned when a record was parsed but couldn't be
+// converted, such as when a field can't be decoded into a struct field.
+type RecordError struct {
+	Line   int    // Line where the record starts, 0 when writing
+	Column string // Column name, if known
+	Err    error  // The actual error
+}
+
+func (e *RecordError) Error() string {
+	msg := "record"
+	if e.Line > 0 {
+		msg += fmt.Sprintf(" on line %d", e.Line)
+	}
+	if e.Column != "" {
+		msg += fmt.Sprintf(", column %q", e.Column)
+	}
+	return fmt.Sprintf("%s: %v", msg, e.Err)
+}
+
+func (e *RecordError) Unwrap() error {
+	return e.Err
+}
+
+// An ErrorPolicy says what a reader does with a record that can't be parsed
+// or has the wrong number of fields.
+type ErrorPolicy int
+
+const (
+	// ErrorAbort returns the error from Read.  It stops the reading unless
+	// the record only had the wrong number of fields, then the record is
+	// returned along with the error.
+	ErrorAbort ErrorPolicy = iota
+	// ErrorSkip skips the record and keeps reading.
+	ErrorSkip
+	// ErrorCallback calls OnError, then skips the record and keeps reading
+	// unless OnError returns an error.
+	ErrorCallback
+)
+
+// A ParseError is returned when a record can't be parsed or has the wrong
+// number of fields.  The embedded *csv.ParseError has the lines and column
+// in the whole input, not just in the record, and errors.As finds it too.
+type ParseError struct {
+	*csv.ParseError
+	Offset int64 // Byte offset where the record starts
+	Record int   // Record number, counting from 1 and including the header
+}
+
+// newParseError returns err, found parsing a record, with the positions
+// changed from being in the record to being in the input
+func newParseError(err *csv.ParseError, line int, offset int64) *ParseError {
+	err.Line = line + err.Line - err.StartLine
+	err.StartLine = line
+	return &ParseError{
+		ParseError: err,
+		Offset:     offset,
+	}
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%v (record %d, byte offset %d)", e.ParseError, e.Record, e.Offset)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.ParseError
 }
 
 // OldReader contains all the internals required.  Use NewReader(io.OldReader).
 type OldReader struct {
 	reader  io.Reader
-	linein  chan []csvLine
-	lineout chan []sliceLine
+	linein  chan rawChunk
+	lineout chan parsedChunk
 	errChan chan error
 	// the following are from encoding/csv package and are copied into the underlying csv.Reader
 	Comma            rune
 	Comment          rune
-	FieldsPerRecord  int // we can't implement this without more overhead/synchronization
+	FieldsPerRecord  int // checked in order by Read, 0 means use the count of the first record
 	LazyQuotes       bool
 	TrailingComma    bool
 	TrimLeadingSpace bool
-	place            int              // how many lines have been returned so far
-	queue            map[int][]string // used to buffer lines that come in out of order
+	ReuseRecord      bool                // share one backing array between the records of a chunk
+	place            int                 // the number of the next chunk to return
+	queue            map[int][]sliceLine // used to buffer chunks that come in out of order
+	current          []sliceLine         // the rest of the chunk being returned
+	produce          func() error        // splits the input into chunks, startReading unless set
+	rangeSize        int64               // the # of bytes in each range of a ReaderAt, ChunkBytes overrides it
+	mapped           []byte              // the memory mapped input, read without copying by startRanges
+	release          func() error        // run by Close once the goroutines are done, unmaps mapped
+	stopped          chan struct{}       // closed once all of the goroutines are done
+	closeErr         error
+	records          int           // the number of the last record returned
+	last             sliceLine     // the last record returned, only raw, line and offset are set
+	lastPos          []position    // where each field of last starts, nil until FieldPos parses it
+	transcoded       Encoding      // UTF16LE or UTF16BE when the input is transcoded to UTF-8 as it's read
+	report           *csv.Writer   // writes to RejectReport
+	inFlight         chan struct{} // holds a value for each chunk sent but not returned yet, nil without MaxInFlight
+	tuner            *chunkTuner   // sizes the chunks with AdaptiveChunks
 	finalError       error
-	cancel           chan struct{} // when this is closed, cancel all operations
+	header           []string                                   // set before headerDone is closed
+	headerErr        error                                      // set before headerDone is closed when there's no header
+	columns          map[string]int                             // the index of each column in header
+	headerDone       chan struct{}                              // closed once the header is known or can't be read
+	transform        func(record []string) (interface{}, error) // run on each record by the parsing goroutines
+	cancel           chan struct{}                              // when this is closed, cancel all operations
+	ctx              context.Context
 	readOnce         sync.Once
+	started          atomic.Bool // set by start, transform can't be changed after
+	readLock         sync.Mutex  // held while returning records, Close takes it before unmapping mapped
+	cancelOnce       sync.Once
 	closeOnce        sync.Once
 	ChunkSize        int // the # of lines to hand to each goroutine -- default 50
+	// If UseHeader is true, the first record is the header.  It's returned
+	// by Header instead of Read and every column in RequiredColumns must be
+	// in it.  Set these before the first call to Read.
+	UseHeader       bool
+	RequiredColumns []string
+	// If Unordered is true, the chunks are returned as soon as they're
+	// parsed instead of in the order of the input.  The records of a chunk
+	// are still in order, ReadRecord returns where each one is.  With
+	// FieldsPerRecord at 0, the first record returned sets the count.
+	Unordered bool
+	// MaxInFlight is the most chunks that are read, being parsed or waiting
+	// to be returned at once, 0 means there's no limit.  Without a limit a
+	// slow chunk lets the chunks after it pile up in memory.
+	MaxInFlight int
+	// Workers is the number of parsing goroutines, GOMAXPROCS when it's 0.
+	Workers int
+	// ErrorPolicy is what's done with records that can't be read.  With
+	// ErrorCallback, OnError is called in order with each bad record, its
+	// line and the *ParseError.  raw is only valid during the call.  If
+	// OnError returns an error, Read returns it and the reading stops.
+	// Errors that aren't from parsing a record, such as an invalid Comma,
+	// always stop the reading.
+	ErrorPolicy ErrorPolicy
+	OnError     func(raw []byte, line int, err error) error
+	// If Rejects is set, every record that can't be read, including the
+	// ones that transform fails on, is written to it as it was in the
+	// input.  UTF-16 input is encoded back to UTF-16 for it, so anything
+	// that wasn't valid UTF-16 is written as U+FFFD.  If RejectReport is set, a CSV report of the line, offset and
+	// error of each of those records is written to it.
+	Rejects      io.Writer
+	RejectReport io.Writer
+	// Input compressed with gzip or bzip2 is decompressed, unless
+	// DisableDecompression is set.  BGZF input, gzip made of blocks that say
+	// how long they are, is decompressed by Workers goroutines.
+	DisableDecompression bool
+	// Encoding is the character encoding of the input, Latin1 and
+	// Windows1252 are transcoded by the parsing goroutines.  A byte order
+	// mark at the start of the input is skipped, with UTF8 a UTF-16 mark
+	// switches to UTF-16.  Comma, Comment and quotes must be ASCII.
+	Encoding Encoding
+	// Terminator is what ends the lines, LFTerminator by default.  With
+	// CRTerminator or AnyTerminator, a lone \r in a quoted field is read
+	// as \n, as encoding/csv does with \r\n.
+	Terminator Terminator
+	// If ChunkBytes is set, ChunkSize and AdaptiveChunks are ignored and each
+	// chunk is cut once its records take at least that many bytes, so that
+	// long records don't make for uneven chunks.
+	ChunkBytes int
+	// If AdaptiveChunks is true, ChunkSize is ignored and the chunks are cut
+	// by bytes instead, growing or shrinking with how long the parsing
+	// goroutines take so that they're all kept busy.
+	AdaptiveChunks bool
 }
 
 // OldNewReader returns a new Reader that reads from r.
@@ -48,29 +225,84 @@ func OldNewReader(r io.Reader) *OldReader {
 
 // NewReader returns a new Reader that reads from r with the chunked size
 func OldNewReaderSized(r io.Reader, chunkSize int) *OldReader {
+	return OldNewReaderContext(context.Background(), r, chunkSize)
+}
+
+// OldNewReaderContext returns a new Reader that reads from r with the chunked
+// size.  When ctx is done all of the goroutines are stopped as if Close was
+// called and Read returns ctx.Err().
+func OldNewReaderContext(ctx context.Context, r io.Reader, chunkSize int) *OldReader {
 	return &OldReader{
-		reader:    r,
-		Comma:     ',',
-		linein:    make(chan []csvLine, chunkSize),
-		lineout:   make(chan []sliceLine, chunkSize),
-		errChan:   make(chan error),
-		queue:     make(map[int][]string),
-		cancel:    make(chan struct{}),
-		ChunkSize: chunkSize,
+		ctx:        ctx,
+		reader:     r,
+		Comma:      ',',
+		linein:     make(chan rawChunk, chunkSize),
+		lineout:    make(chan parsedChunk, chunkSize),
+		errChan:    make(chan error, 1),
+		queue:      make(map[int][]sliceLine),
+		headerDone: make(chan struct{}),
+		cancel:     make(chan struct{}),
+		stopped:    make(chan struct{}),
+		ChunkSize:  chunkSize,
 	}
 }
 
 // Close will clean up any goroutines that aren't finished.
 // It will also close the underlying Reader if it implements io.ReadCloser
 func (mcr *OldReader) Close() error {
-	var insideError error
 	mcr.closeOnce.Do(func() {
-		close(mcr.cancel)
+		mcr.stop()
+		if mcr.release != nil {
+			// the goroutines may still be parsing the mapped memory
+			mcr.start()
+			<-mcr.stopped
+			// and the chunks waiting to be returned point into it
+			mcr.readLock.Lock()
+			defer mcr.readLock.Unlock()
+			mcr.current = nil
+			mcr.queue = make(map[int][]sliceLine)
+			mcr.last.raw = append([]byte(nil), mcr.last.raw...) // for FieldPos
+			if mcr.finalError == nil {
+				mcr.finalError = ErrReaderClosed
+			}
+			mcr.closeErr = mcr.release()
+			return
+		}
 		if c, ok := mcr.reader.(io.Closer); ok {
-			insideError = c.Close()
+			mcr.closeErr = c.Close()
 		}
 	})
-	return insideError
+	return mcr.closeErr
+}
+
+// stop cancels all of the goroutines
+func (mcr *OldReader) stop() {
+	mcr.cancelOnce.Do(func() {
+		close(mcr.cancel)
+	})
+}
+
+// end stops the reading after next returns an error.  A mapped file stays
+// mapped until Close, which would wait for next to let go of readLock.
+func (mcr *OldReader) end() {
+	if mcr.release != nil {
+		mcr.stop()
+		return
+	}
+	_ = mcr.Close()
+}
+
+// abort is called by a parsing goroutine that fails to stop all of the
+// others.  Close can't be called directly when there's mapped memory, it
+// would wait for the goroutine calling it.
+func (mcr *OldReader) abort() {
+	if mcr.release != nil {
+		go func() {
+			_ = mcr.Close()
+		}()
+		return
+	}
+	_ = mcr.Close()
 }
 
 // ReadAll reads all the remaining records from r.
@@ -115,76 +347,369 @@ func (mcr *OldReader) Stream() (chan []string, chan error) {
 	return out, errChan
 }
 
+// StreamBatches is like Stream, but sends the records a chunk at a time as
+// returned by ReadBatch.
+func (mcr *OldReader) StreamBatches() (chan [][]string, chan error) {
+	out := make(chan [][]string)
+	errChan := make(chan error, 1)
+	go func() {
+		defer close(out)
+		defer close(errChan)
+		for {
+			batch, err := mcr.ReadBatch()
+			if len(batch) > 0 {
+				out <- batch
+			}
+			if err == nil {
+				continue
+			}
+			if err == io.EOF {
+				return
+			}
+			errChan <- err
+			return
+		}
+	}()
+	return out, errChan
+}
+
 // Read reads one record from r.  The record is a slice of strings with each
 // string representing one field.  In the background, the internal io.Reader
 // will be read from ahead of the caller utilizing Read() to pull every row
+//
+// If the record has an unexpected number of fields, Read returns the record
+// along with the error csv.ErrFieldCount wrapped in a *ParseError.
 func (mcr *OldReader) Read() ([]string, error) {
+	line, err := mcr.next()
+	return line.data, err
+}
+
+// ReadBatch reads the records of a chunk at once, in order.  It returns the
+// rest of the chunk a record was last read from, or the next chunk.  A batch
+// stops short of a record with an error, the next call returns that record
+// alone with its error like Read does.
+func (mcr *OldReader) ReadBatch() ([][]string, error) {
+	mcr.readLock.Lock()
+	defer mcr.readLock.Unlock()
+	line, err := mcr.nextLocked()
+	if line.data == nil {
+		return nil, err
+	}
+	batch := make([][]string, 1, len(mcr.current)+1)
+	batch[0] = line.data
+	if err != nil {
+		return batch, err
+	}
+	for len(mcr.current) > 0 {
+		line := mcr.current[0]
+		if line.err != nil || (mcr.FieldsPerRecord > 0 && len(line.data) > 0 && len(line.data) != mcr.FieldsPerRecord) {
+			break // left for next
+		}
+		mcr.current = mcr.current[1:]
+		if len(line.data) > 0 {
+			mcr.countRecord(line)
+			batch = append(batch, line.data)
+		}
+	}
+	return batch, nil
+}
+
+// next returns the next record in order, or in any order with Unordered,
+// skipping blank lines and comments
+func (mcr *OldReader) next() (sliceLine, error) {
+	mcr.readLock.Lock()
+	defer mcr.readLock.Unlock()
+	return mcr.nextLocked()
+}
+
+// nextLocked is next for when readLock is held
+func (mcr *OldReader) nextLocked() (sliceLine, error) {
+	if mcr.finalError == nil {
+		mcr.finalError = mcr.ctx.Err()
+	}
 	if mcr.finalError != nil {
-		return nil, mcr.finalError
+		return sliceLine{}, mcr.finalError
 	}
 	mcr.start()
 	for {
-		line, ok := mcr.queue[mcr.place]
-		if !ok {
-			break // next value isn't in the queue, move on
-		}
-		delete(mcr.queue, mcr.place)
-		mcr.place++
-		if len(line) == 0 {
+		if len(mcr.current) == 0 {
+			num := mcr.place
+			if mcr.Unordered {
+				for num = range mcr.queue {
+					break // any chunk will do
+				}
+			}
+			lines, ok := mcr.queue[num]
+			if !ok {
+				if !mcr.fillQueue() {
+					if mcr.finalError = mcr.ctx.Err(); mcr.finalError == nil {
+						mcr.finalError = <-mcr.errChan
+					}
+					return sliceLine{}, mcr.finalError
+				}
+				continue // keep going, didn't find what we were looking for yet!
+			}
+			delete(mcr.queue, num)
+			mcr.place++
+			if mcr.inFlight != nil {
+				<-mcr.inFlight
+			}
+			mcr.current = lines
 			continue
 		}
-		return line, nil
-	}
-	found := false
-	var foundVal []string
-	for lines := range mcr.lineout {
-		for _, line := range lines {
-			if line.num == mcr.place {
-				found = true
-				foundVal = line.data
-			} else {
-				mcr.queue[line.num] = line.data
+		line := mcr.current[0]
+		mcr.current = mcr.current[1:]
+		if len(line.data) == 0 && line.err == nil {
+			continue // blank line or comment
+		}
+		if line.stop {
+			// such as a bad Comma, every record would fail the same way
+			mcr.finalError = line.err
+			mcr.end()
+			return sliceLine{}, line.err
+		}
+		mcr.countRecord(line)
+		err := line.err
+		if err == nil {
+			err = mcr.checkFieldCount(line, mcr.records)
+		}
+		if err != nil {
+			if rerr := mcr.reject(line, err); rerr != nil {
+				mcr.finalError = rerr
+				mcr.end()
+				return sliceLine{}, rerr
 			}
 		}
-		if found {
-			mcr.place++
-			return foundVal, nil
-		} // else, keep going, didn't find what we were looking for yet!
+		switch {
+		case err == nil:
+			return line, nil
+		case line.err != nil && !line.fatal:
+			return line, err // it was parsed, but transform failed
+		case mcr.ErrorPolicy == ErrorAbort && !line.fatal:
+			return line, err
+		case mcr.ErrorPolicy != ErrorAbort:
+			if err = mcr.skip(line, err); err == nil {
+				continue
+			}
+		}
+		mcr.finalError = err
+		mcr.end()
+		return sliceLine{}, err
 	}
-	mcr.finalError = <-mcr.errChan
-	return nil, mcr.finalError
 }
 
-func (mcr *OldReader) startReading() error {
+// skip is called with the error for a bad record when ErrorPolicy isn't
+// ErrorAbort.  It returns nil when the record is to be skipped, otherwise
+// the error to stop reading with.
+func (mcr *OldReader) skip(line sliceLine, err error) error {
+	if mcr.ErrorPolicy == ErrorCallback && mcr.OnError != nil {
+		return mcr.OnError(line.raw, line.line, err)
+	}
+	return nil
+}
+
+// countRecord numbers the record being returned, the number is added to its
+// *ParseError.  The record is kept for FieldPos and InputOffset.
+func (mcr *OldReader) countRecord(line sliceLine) {
+	if mcr.records == 0 && mcr.header != nil {
+		mcr.records = 1 // the header
+	}
+	mcr.records++
+	if pe, ok := line.err.(*ParseError); ok {
+		pe.Record = mcr.records
+	}
+	mcr.last = sliceLine{
+		raw:    line.raw,
+		line:   line.line,
+		offset: line.offset,
+	}
+	mcr.lastPos = nil
+}
+
+// position is where a field starts, as returned by FieldPos
+type position struct {
+	line, column int
+}
+
+// FieldPos returns the line and column where the field with the given index
+// starts in the record most recently returned, like csv.Reader.FieldPos
+// does.  Lines and columns are numbered from 1, columns count bytes.  If the
+// index is out of bounds, FieldPos panics.  For a record that couldn't be
+// parsed, it returns where the record starts.
+func (mcr *OldReader) FieldPos(field int) (line, column int) {
+	mcr.readLock.Lock()
+	defer mcr.readLock.Unlock()
+	if mcr.lastPos == nil {
+		mcr.lastPos = mcr.fieldPositions()
+	}
+	if len(mcr.lastPos) == 0 {
+		return mcr.last.line, 1
+	}
+	pos := mcr.lastPos[field]
+	return pos.line, pos.column
+}
+
+// fieldPositions parses the last record to find where its fields start, it
+// returns an empty slice when the record can't be parsed
+func (mcr *OldReader) fieldPositions() []position {
+	var buf bytes.Buffer
+	mcr.writeRecord(&buf, mcr.last.raw)
+	cr := mcr.newCSVReader(&buf)
+	record, err := cr.Read()
+	if err != nil {
+		return []position{}
+	}
+	first, _ := cr.FieldPos(0)
+	positions := make([]position, len(record))
+	for i := range record {
+		line, column := cr.FieldPos(i)
+		positions[i] = position{mcr.last.line + line - first, column}
+	}
+	return positions
+}
+
+// InputOffset returns the byte offset of the end of the record most
+// recently returned, like csv.Reader.InputOffset does.
+func (mcr *OldReader) InputOffset() int64 {
+	mcr.readLock.Lock()
+	defer mcr.readLock.Unlock()
+	return mcr.last.offset + int64(len(mcr.last.raw))
+}
+
+// fillQueue adds the next chunk from the parsing goroutines to the queue.  It
+// returns false once all of the chunks have been received or ctx is done.
+func (mcr *OldReader) fillQueue() bool {
+	var parsed parsedChunk
+	var ok bool
+	select {
+	case parsed, ok = <-mcr.lineout:
+	case <-mcr.ctx.Done():
+	}
+	if !ok {
+		return false
+	}
+	mcr.queue[parsed.num] = parsed.lines
+	return true
+}
+
+// checkFieldCount enforces FieldsPerRecord like encoding/csv does.  It's only
+// done here as the records are returned in order, the parsing goroutines
+// never know which record is first.
+func (mcr *OldReader) checkFieldCount(line sliceLine, record int) error {
+	switch {
+	case mcr.FieldsPerRecord < 0:
+		return nil
+	case mcr.FieldsPerRecord == 0:
+		mcr.FieldsPerRecord = len(line.data)
+		return nil
+	case len(line.data) != mcr.FieldsPerRecord:
+		return &ParseError{
+			ParseError: &csv.ParseError{
+				StartLine: line.line,
+				Line:      line.line,
+				Column:    1,
+				Err:       csv.ErrFieldCount,
+			},
+			Offset: line.offset,
+			Record: record,
+		}
+	}
+	return nil
+}
+
+// newCSVReader returns a csv.Reader configured to parse single records
+func (mcr *OldReader) newCSVReader(r io.Reader) *csv.Reader {
+	cr := csv.NewReader(r)
+	cr.Comma = mcr.Comma
+	cr.Comment = mcr.Comment
+	cr.FieldsPerRecord = -1 // each goroutine only sees some of the records
+	cr.LazyQuotes = mcr.LazyQuotes
+	cr.TrailingComma = mcr.TrailingComma
+	cr.TrimLeadingSpace = mcr.TrimLeadingSpace
+	cr.ReuseRecord = mcr.ReuseRecord
+	return cr
+}
+
+// isRecord reports whether data holds a record rather than being blank or a comment
+func (mcr *OldReader) isRecord(data []byte) bool {
+	if len(data) == 0 || data[0] == '\n' {
+		return false
+	}
+	if data[0] == '\r' && (len(data) == 1 || data[1] == '\n') {
+		return false
+	}
+	return mcr.Comment == 0 || !startsWithRune(data, mcr.Comment)
+}
+
+func (mcr *OldReader) startReading() (err error) {
 	defer close(mcr.linein)
-	linenum := 0
-	bytesreader := bufio.NewReader(mcr.reader)
+	if mcr.UseHeader {
+		defer func() {
+			mcr.headerNotFound(err)
+		}()
+	}
+	linenum := 0     // the lines before record
+	var offset int64 // the bytes before record
+	chunknum := 0
+	chunkBytes := 0
+	input, err := mcr.decompress(bufio.NewReader(mcr.reader))
+	if err != nil {
+		return err
+	}
+	input, bom := mcr.decodeInput(bufio.NewReader(input))
+	offset = int64(bom)
+	bytesreader := bufio.NewReader(input)
+	qs := mcr.newQuoteScanner()
+	var record []byte // a record with quoted newlines is collected here until complete
 NextChunk:
 	for {
 		toBeParsed := make([]csvLine, 0, mcr.ChunkSize)
 		for {
-			line, err := bytesreader.ReadBytes('\n')
+			line, err := mcr.readLine(bytesreader)
 			if len(line) > 0 {
-				if line[0] == '\r' {
-					continue // we don't care about 'blank' lines from Windows style
+				complete := qs.scan(line, record == nil)
+				if record == nil {
+					record = line
+				} else {
+					record = append(record, line...)
+				}
+				if !complete && err == nil {
+					continue // the newline was inside a quoted field
 				}
-				toBeParsed = append(toBeParsed, csvLine{
-					data: line,
-					num:  linenum,
-				})
-				linenum++
+			}
+			if record != nil {
+				next := csvLine{
+					data:   record,
+					line:   linenum + 1,
+					offset: offset,
+				}
+				linenum += mcr.countLines(record)
+				offset += int64(len(record))
+				if mcr.UseHeader && mcr.header == nil && mcr.isRecord(record) {
+					if err := mcr.readHeader(next); err != nil {
+						return err
+					}
+					next.data = nil // only the number is sent on
+				}
+				toBeParsed = append(toBeParsed, next)
+				chunkBytes += len(next.data)
+				record = nil
 			}
 			if err == nil || err == io.EOF {
-				if len(toBeParsed) == mcr.ChunkSize || err == io.EOF {
-					select {
-					case mcr.linein <- toBeParsed:
-						if err == io.EOF {
-							return nil
-						}
-						continue NextChunk
-					case <-mcr.cancel:
+				if mcr.UseHeader && mcr.header == nil && err == nil {
+					// only blank lines and comments so far, they aren't sent
+					// as nothing reads the chunks until Header returns
+					toBeParsed = toBeParsed[:0]
+					chunkBytes = 0
+					continue
+				}
+				if mcr.chunkFull(len(toBeParsed), chunkBytes) || err == io.EOF {
+					if !mcr.send(rawChunk{num: chunknum, lines: toBeParsed}) || err == io.EOF {
 						return nil
 					}
+					chunknum++
+					chunkBytes = 0
+					continue NextChunk
 				}
 				continue
 			}
@@ -193,48 +718,117 @@ NextChunk:
 	}
 }
 
+// chunkFull reports whether a chunk of n records taking size bytes is ready
+// to be sent
+func (mcr *OldReader) chunkFull(n, size int) bool {
+	switch {
+	case mcr.ChunkBytes > 0:
+		return size >= mcr.ChunkBytes
+	case mcr.tuner != nil:
+		return size >= mcr.tuner.size()
+	}
+	return n == mcr.ChunkSize
+}
+
+// send hands chunk to the parsing goroutines, first waiting for one of the
+// chunks in flight to be returned when there are MaxInFlight of them.  It
+// returns false once cancelled.
+func (mcr *OldReader) send(chunk rawChunk) bool {
+	if mcr.inFlight != nil {
+		select {
+		case mcr.inFlight <- struct{}{}:
+		case <-mcr.cancel:
+			return false
+		}
+	}
+	select {
+	case mcr.linein <- chunk:
+		return true
+	case <-mcr.cancel:
+		return false
+	}
+}
+
 func (mcr *OldReader) parseCSVLines() error {
 	var buf bytes.Buffer
-	r := csv.NewReader(&buf)
-	r.Comma = mcr.Comma
-	r.Comment = mcr.Comment
-	r.LazyQuotes = mcr.LazyQuotes
-	r.TrailingComma = mcr.TrailingComma
-	r.TrimLeadingSpace = mcr.TrimLeadingSpace
-	for toBeParsed := range mcr.linein {
-		parsed := make([]sliceLine, 0, len(toBeParsed))
-		for _, b := range toBeParsed {
-			buf.Reset()
-			_, _ = buf.Write(b.data)
-			char, _, err := buf.ReadRune()
-			if err != nil {
-				_ = mcr.Close()
+	r := mcr.newCSVReader(&buf)
+	var fields []string // with ReuseRecord, holds every field of the chunk
+	for chunk := range mcr.linein {
+		size := 0 // bytes parsed, for the tuner
+		toBeParsed := chunk.lines
+		if chunk.load != nil {
+			var err error
+			if toBeParsed, err = chunk.load(); err != nil {
+				mcr.abort()
 				return err
 			}
-			if char == '\n' || char == mcr.Comment {
+		}
+		var began time.Time
+		if mcr.tuner != nil {
+			began = time.Now()
+		}
+		parsed := make([]sliceLine, 0, len(toBeParsed))
+		if mcr.ReuseRecord {
+			fields = make([]string, 0, len(fields)) // the last chunk is a good guess
+		}
+		for _, b := range toBeParsed {
+			if b.data == nil || !mcr.isRecord(b.data) {
 				parsed = append(parsed, sliceLine{
 					data: nil,
-					num:  b.num,
+					line: b.line,
 				})
 				continue
 			}
-			_ = buf.UnreadRune()
+			buf.Reset()
+			mcr.writeRecord(&buf, b.data)
+			size += len(b.data)
 			line, err := r.Read()
 			if err != nil {
 				pe, ok := err.(*csv.ParseError)
 				if ok {
-					pe.Line = b.num + 1
+					err = newParseError(pe, b.line, b.offset)
+				}
+				// it's returned in order, after the records before it
+				parsed = append(parsed, sliceLine{
+					raw:    b.data,
+					line:   b.line,
+					offset: b.offset,
+					err:    err,
+					fatal:  true,
+					stop:   !ok,
+				})
+				if mcr.ErrorPolicy == ErrorAbort || !ok {
+					break
+				}
+				r = mcr.newCSVReader(&buf) // don't read what's left of the bad record
+				continue
+			}
+			if mcr.ReuseRecord {
+				start := len(fields)
+				fields = append(fields, line...)
+				line = fields[start:len(fields):len(fields)]
+			}
+			var value interface{}
+			if mcr.transform != nil {
+				value, err = mcr.transform(line)
+				if err != nil {
+					err = newRecordError(err, b.line)
 				}
-				_ = mcr.Close()
-				return err
 			}
 			parsed = append(parsed, sliceLine{
-				data: line,
-				num:  b.num,
+				data:   line,
+				raw:    b.data,
+				line:   b.line,
+				offset: b.offset,
+				value:  value,
+				err:    err,
 			})
 		}
+		if mcr.tuner != nil {
+			mcr.tuner.observe(size, time.Since(began))
+		}
 		select {
-		case mcr.lineout <- parsed:
+		case mcr.lineout <- parsedChunk{num: chunk.num, lines: parsed}:
 		case <-mcr.cancel:
 			return nil
 		}
@@ -242,9 +836,28 @@ func (mcr *OldReader) parseCSVLines() error {
 	return nil
 }
 
-func (mcr *OldReader) waitForDone(err1, err2 chan error) {
+// newRecordError sets the line of err if it's a *RecordError, otherwise it
+// wraps err in one
+func newRecordError(err error, line int) error {
+	re, ok := err.(*RecordError)
+	if !ok {
+		re = &RecordError{Err: err}
+	}
+	re.Line = line
+	return re
+}
+
+// workers returns the number of goroutines to start when n are asked for
+func workers(n int) int {
+	if n < 1 {
+		return runtime.GOMAXPROCS(0)
+	}
+	return n
+}
+
+func (mcr *OldReader) waitForDone(err1, err2 chan error, workers int) {
 	foundError := <-err1
-	for i := 0; i < runtime.NumCPU(); i++ {
+	for i := 0; i < workers; i++ {
 		err := <-err2
 		if err != nil && err != io.EOF && foundError == nil {
 			foundError = err
@@ -254,21 +867,54 @@ func (mcr *OldReader) waitForDone(err1, err2 chan error) {
 		foundError = io.EOF
 	}
 	close(mcr.lineout)
+	close(mcr.stopped)
 	mcr.errChan <- foundError
 }
 
+// setTransform sets transform, which is only safe before the parsing
+// goroutines are started.  UseHeader is set too when header is true.
+func (mcr *OldReader) setTransform(transform func(record []string) (interface{}, error), header bool) error {
+	if mcr.started.Load() {
+		return ErrReaderStarted
+	}
+	mcr.transform = transform
+	mcr.UseHeader = mcr.UseHeader || header
+	return nil
+}
+
 func (mcr *OldReader) start() {
 	mcr.readOnce.Do(func() {
+		mcr.started.Store(true)
+		if mcr.MaxInFlight > 0 {
+			mcr.inFlight = make(chan struct{}, mcr.MaxInFlight)
+		}
+		if mcr.AdaptiveChunks {
+			mcr.tuner = newChunkTuner()
+		}
 		err1 := make(chan error, 1)
 		err2 := make(chan error)
+		produce := mcr.produce
+		if produce == nil {
+			produce = mcr.startReading
+		}
 		go func() {
-			err1 <- mcr.startReading()
+			err1 <- produce()
 		}()
-		for i := 0; i < runtime.NumCPU(); i++ {
+		n := workers(mcr.Workers)
+		for i := 0; i < n; i++ {
 			go func() {
 				err2 <- mcr.parseCSVLines()
 			}()
 		}
-		go mcr.waitForDone(err1, err2)
+		go mcr.waitForDone(err1, err2, n)
+		if done := mcr.ctx.Done(); done != nil {
+			go func() {
+				select {
+				case <-done:
+					_ = mcr.Close()
+				case <-mcr.cancel:
+				}
+			}()
+		}
 	})
 }
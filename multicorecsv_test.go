@@ -6,12 +6,23 @@ package multicorecsv
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/csv"
+	"errors"
+	"fmt"
 	"io"
 	"math/rand"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
 )
 
 var readTests = []struct {
@@ -47,22 +58,22 @@ var readTests = []struct {
 		Input:  "a,b\rc,d\r\n",
 		Output: [][]string{{"a", "b\rc", "d"}},
 	},
-	//	{
-	//		Name:               "RFC4180test",
-	//		UseFieldsPerRecord: true,
-	//		Input: `#field1,field2,field3
-	//				"aaa","bb
-	//				b","ccc"
-	//				"a,a","b""bb","ccc"
-	//				zzz,yyy,xxx
-	//				`,
-	//		Output: [][]string{
-	//			{"#field1", "field2", "field3"},
-	//			{"aaa", "bb\nb", "ccc"},
-	//			{"a,a", `b"bb`, "ccc"},
-	//			{"zzz", "yyy", "xxx"},
-	//		},
-	//	},
+	{
+		Name:               "RFC4180test",
+		UseFieldsPerRecord: true,
+		Input: `#field1,field2,field3
+"aaa","bb
+b","ccc"
+"a,a","b""bb","ccc"
+zzz,yyy,xxx
+`,
+		Output: [][]string{
+			{"#field1", "field2", "field3"},
+			{"aaa", "bb\nb", "ccc"},
+			{"a,a", `b"bb`, "ccc"},
+			{"zzz", "yyy", "xxx"},
+		},
+	},
 	{
 		Name:   "NoEOLTest",
 		Input:  "a,b,c",
@@ -74,14 +85,37 @@ var readTests = []struct {
 		Input:  "a;b;c\n",
 		Output: [][]string{{"a", "b", "c"}},
 	},
-	//	{
-	//		Name: "MultiLine",
-	//		Input: `"two
-	//				line","one line","three
-	//				line
-	//				field"`,
-	//		Output: [][]string{{"two\nline", "one line", "three\nline\nfield"}},
-	//	},
+	{
+		Name: "MultiLine",
+		Input: `"two
+line","one line","three
+line
+field"`,
+		Output: [][]string{{"two\nline", "one line", "three\nline\nfield"}},
+	},
+	{
+		Name:   "MultiLineCRLF",
+		Input:  "\"a\r\n\r\nb\",c\r\nd,e\r\n",
+		Output: [][]string{{"a\n\nb", "c"}, {"d", "e"}},
+	},
+	{
+		Name:    "MultiLineComment",
+		Comment: '#',
+		Input:   "#\"\na,\"b\nc\"\n",
+		Output:  [][]string{{"a", "b\nc"}},
+	},
+	{
+		Name:       "MultiLineLazyQuotes",
+		LazyQuotes: true,
+		Input:      "a,\"b \"c\" d\ne\"\nf,g\n",
+		Output:     [][]string{{"a", "b \"c\" d\ne"}, {"f", "g"}},
+	},
+	{
+		Name:             "MultiLineTrimQuote",
+		TrimLeadingSpace: true,
+		Input:            "a,  \"b\nc\"\nd,e\n",
+		Output:           [][]string{{"a", "b\nc"}, {"d", "e"}},
+	},
 	{
 		Name:  "BlankLine",
 		Input: "a,b,c\n\nd,e,f\n\n",
@@ -170,24 +204,24 @@ var readTests = []struct {
 		Input: `"a "word","b"`,
 		Error: `extraneous or missing " in quoted-field`, Line: 1, Column: 4,
 	},
-	//	{
-	//		Name:               "BadFieldCount",
-	//		UseFieldsPerRecord: true,
-	//		Input:              "a,b,c\nd,e",
-	//		Error:              "wrong number of fields", Line: 2,
-	//	},
-	//	{
-	//		Name:               "BadFieldCount1",
-	//		UseFieldsPerRecord: true,
-	//		FieldsPerRecord:    2,
-	//		Input:              `a,b,c`,
-	//		Error:              "wrong number of fields", Line: 1,
-	//	},
-	//	{
-	//		Name:   "FieldCount",
-	//		Input:  "a,b,c\nd,e",
-	//		Output: [][]string{{"a", "b", "c"}, {"d", "e"}},
-	//	},
+	{
+		Name:               "BadFieldCount",
+		UseFieldsPerRecord: true,
+		Input:              "a,b,c\nd,e",
+		Error:              "wrong number of fields", Line: 2, Column: 1,
+	},
+	{
+		Name:               "BadFieldCount1",
+		UseFieldsPerRecord: true,
+		FieldsPerRecord:    2,
+		Input:              `a,b,c`,
+		Error:              "wrong number of fields", Line: 1, Column: 1,
+	},
+	{
+		Name:   "FieldCount",
+		Input:  "a,b,c\nd,e",
+		Output: [][]string{{"a", "b", "c"}, {"d", "e"}},
+	},
 	{
 		Name:   "TrailingCommaEOF",
 		Input:  "a,b,c,",
@@ -216,6 +250,12 @@ var readTests = []struct {
 		Input:            "a,b,c\nd,e,f\ng,hi,",
 		Output:           [][]string{{"a", "b", "c"}, {"d", "e", "f"}, {"g", "hi", ""}},
 	},
+	{
+		Name:             "TrimLeadingSpaceBareCR",
+		TrimLeadingSpace: true,
+		Input:            "\r\"\r\na\r\"",
+		Output:           [][]string{{"\na\r"}},
+	},
 	{
 		Name:   "NotTrailingComma3",
 		Input:  "a,b,c, \n",
@@ -299,7 +339,8 @@ func TestRead(t *testing.T) {
 			r.Comma = tt.Comma
 		}
 		out, err := r.ReadAll()
-		perr, _ := err.(*csv.ParseError)
+		var perr *csv.ParseError
+		errors.As(err, &perr)
 		if tt.Error != "" {
 			if err == nil || !strings.Contains(err.Error(), tt.Error) {
 				t.Errorf("%s: error %v, want error %q", tt.Name, err, tt.Error)
@@ -315,6 +356,1130 @@ func TestRead(t *testing.T) {
 	}
 }
 
+func TestFieldsPerRecordAcrossChunks(t *testing.T) {
+	var in bytes.Buffer
+	for x := 0; x < 100; x++ {
+		in.WriteString("a,b,c\n")
+	}
+	in.WriteString("d,e\n")
+	for _, fields := range []int{0, 3} {
+		r := OldNewReaderSized(bytes.NewReader(in.Bytes()), 1)
+		r.FieldsPerRecord = fields
+		var record []string
+		var err error
+		for err == nil {
+			record, err = r.Read()
+		}
+		r.Close()
+		var perr *csv.ParseError
+		if !errors.As(err, &perr) || perr.Err != csv.ErrFieldCount || perr.Line != 101 {
+			t.Errorf("FieldsPerRecord %d: error %v, want wrong number of fields on line 101", fields, err)
+		}
+		if !reflect.DeepEqual(record, []string{"d", "e"}) {
+			t.Errorf("FieldsPerRecord %d: record %q returned with the error, want %q", fields, record, []string{"d", "e"})
+		}
+	}
+}
+
+func TestHeader(t *testing.T) {
+	in := "# people\nname,email\nrob,rob@example.com\nken\n"
+	r := NewReaderWithOptions(strings.NewReader(in), ReaderOptions{
+		Comment:         '#',
+		FieldsPerRecord: -1,
+		UseHeader:       true,
+		RequiredColumns: []string{"email"},
+		ChunkSize:       1,
+	})
+	header, err := r.Header()
+	if err != nil || !reflect.DeepEqual(header, []string{"name", "email"}) {
+		t.Errorf("Header returned %q, %v", header, err)
+	}
+	record, err := r.ReadRecord()
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if got := record.Get("email"); got != "rob@example.com" {
+		t.Errorf("Get(email) = %q", got)
+	}
+	if got := record.Map(); !reflect.DeepEqual(got, map[string]string{"name": "rob", "email": "rob@example.com"}) {
+		t.Errorf("Map() = %q", got)
+	}
+	record, err = r.ReadRecord()
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if field, ok := record.Lookup("email"); ok {
+		t.Errorf("Lookup(email) of a short record = %q, true", field)
+	}
+	if _, ok := record.Lookup("phone"); ok {
+		t.Error("Lookup(phone) found a missing column")
+	}
+	if _, err = r.ReadRecord(); err != io.EOF {
+		t.Errorf("ReadRecord returned %v at the end, want %v", err, io.EOF)
+	}
+	r.Close()
+
+	for _, tt := range []struct {
+		Input  string
+		Column string
+		Err    error
+	}{
+		{Input: "a,b,a\n1,2,3\n", Column: "a", Err: ErrDuplicateColumn},
+		{Input: "name\nrob\n", Column: "email", Err: ErrMissingColumn},
+	} {
+		r := NewReaderWithOptions(strings.NewReader(tt.Input), ReaderOptions{UseHeader: true, RequiredColumns: []string{"email"}})
+		_, err := r.Read()
+		var re *RecordError
+		if !errors.As(err, &re) || re.Err != tt.Err || re.Column != tt.Column || re.Line != 1 {
+			t.Errorf("%q: error %v, want %v for column %q on line 1", tt.Input, err, tt.Err, tt.Column)
+		}
+		if _, herr := r.Header(); herr != err {
+			t.Errorf("%q: Header returned %v, want %v", tt.Input, herr, err)
+		}
+		r.Close()
+	}
+}
+
+func TestHeaderAfterComments(t *testing.T) {
+	in := strings.Repeat("# comment\n", 200) + "\nname,email\nrob,rob@example.com\n"
+	r := NewReaderWithOptions(strings.NewReader(in), ReaderOptions{
+		Comment:   '#',
+		UseHeader: true,
+		ChunkSize: 1,
+	})
+	defer r.Close()
+	header, err := r.Header()
+	if err != nil || !reflect.DeepEqual(header, []string{"name", "email"}) {
+		t.Fatalf("Header returned %q, %v", header, err)
+	}
+	record, err := r.ReadRecord()
+	if err != nil || record.Get("email") != "rob@example.com" || record.Line != 203 {
+		t.Errorf("ReadRecord returned %q on line %d, %v", record.Fields, record.Line, err)
+	}
+}
+
+func TestParseErrorPosition(t *testing.T) {
+	in := "a,b\n\n\"c\nd\",e\n\r\nf,\"g\n\"h\"\ni,j\n"
+	_, err := csv.NewReader(strings.NewReader(in)).ReadAll()
+	var want *csv.ParseError
+	if !errors.As(err, &want) {
+		t.Fatalf("encoding/csv returned %v", err)
+	}
+	for _, useHeader := range []bool{false, true} {
+		readers := map[string]*OldReader{
+			"chunk size 1":  OldNewReaderSized(strings.NewReader(in), 1),
+			"chunk size 50": OldNewReader(strings.NewReader(in)),
+			"ReaderAt":      OldNewReaderAt(strings.NewReader(in), int64(len(in))),
+		}
+		for name, r := range readers {
+			r.UseHeader = useHeader
+			_, err := r.ReadAll()
+			r.Close()
+			var perr *ParseError
+			if !errors.As(err, &perr) {
+				t.Errorf("%s: error %v, want a *ParseError", name, err)
+				continue
+			}
+			if perr.StartLine != want.StartLine || perr.Line != want.Line || perr.Column != want.Column {
+				t.Errorf("%s: error at %d-%d:%d, want %d-%d:%d", name, perr.StartLine, perr.Line, perr.Column, want.StartLine, want.Line, want.Column)
+			}
+			if perr.Offset != 15 || perr.Record != 3 {
+				t.Errorf("%s: error at offset %d, record %d, want offset 15, record 3", name, perr.Offset, perr.Record)
+			}
+		}
+	}
+
+	r := OldNewReader(strings.NewReader("a,b\n\nc\n"))
+	defer r.Close()
+	_, err = r.ReadAll()
+	var perr *ParseError
+	if !errors.As(err, &perr) || !errors.Is(err, csv.ErrFieldCount) || perr.Line != 3 || perr.Offset != 5 || perr.Record != 2 {
+		t.Errorf("error %v, want wrong number of fields on line 3, offset 5, record 2", err)
+	}
+}
+
+func TestFieldPos(t *testing.T) {
+	in := "a,b\n\n\"c\nd\",  e\r\n# comment\nf,\"g\n\n\"\"h\",i\nj"
+	type position struct {
+		Line, Column int
+	}
+	var want [][]position
+	var wantOffsets []int64
+	cr := csv.NewReader(strings.NewReader(in))
+	cr.Comment = '#'
+	cr.FieldsPerRecord = -1
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Error reading with encoding/csv - %v", err)
+		}
+		var fields []position
+		for i := range record {
+			line, column := cr.FieldPos(i)
+			fields = append(fields, position{line, column})
+		}
+		want = append(want, fields)
+		wantOffsets = append(wantOffsets, cr.InputOffset())
+	}
+	path := filepath.Join(t.TempDir(), "test.csv")
+	if err := os.WriteFile(path, []byte(in), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	mapped, err := Open(path, ReaderOptions{})
+	if err != nil {
+		t.Fatalf("Error opening %s - %v", path, err)
+	}
+	readers := map[string]*OldReader{
+		"chunk size 1":  OldNewReaderSized(strings.NewReader(in), 1),
+		"chunk size 50": OldNewReader(strings.NewReader(in)),
+		"ReaderAt":      OldNewReaderAt(strings.NewReader(in), int64(len(in))),
+		"Open":          mapped.mcr,
+	}
+	for name, r := range readers {
+		r.Comment = '#'
+		r.FieldsPerRecord = -1
+		var got [][]position
+		var gotOffsets []int64
+		for {
+			record, err := r.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s: unexpected error - %v", name, err)
+			}
+			var fields []position
+			for i := range record {
+				line, column := r.FieldPos(i)
+				fields = append(fields, position{line, column})
+			}
+			got = append(got, fields)
+			gotOffsets = append(gotOffsets, r.InputOffset())
+		}
+		r.Close()
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: field positions %v, want %v", name, got, want)
+		}
+		if !reflect.DeepEqual(gotOffsets, wantOffsets) {
+			t.Errorf("%s: offsets %v, want %v", name, gotOffsets, wantOffsets)
+		}
+	}
+
+	// the record is only copied out of the mapping by Close
+	mapped, err = Open(path, ReaderOptions{Comment: '#', FieldsPerRecord: -1})
+	if err != nil {
+		t.Fatalf("Error opening %s - %v", path, err)
+	}
+	for x := 0; x < 3; x++ {
+		if _, err := mapped.Read(); err != nil {
+			t.Fatalf("unexpected error - %v", err)
+		}
+	}
+	if r := mapped.mcr; &r.last.raw[0] != &r.mapped[r.last.offset] {
+		t.Error("the record was copied out of the mapping")
+	}
+	mapped.Close()
+	for i := 1; i < 3; i++ {
+		line, column := mapped.FieldPos(i)
+		if got := (position{line, column}); got != want[2][i] {
+			t.Errorf("FieldPos(%d) after Close is %v, want %v", i, got, want[2][i])
+		}
+		if i == 1 {
+			mapped.mcr.last.raw = nil // the record is only parsed once
+		}
+	}
+}
+
+func TestErrorPolicy(t *testing.T) {
+	in := "a,b\nc,d\"x\ne,f\n\"g\n\"h,i\nj\nk,l\n"
+	want := [][]string{{"a", "b"}, {"e", "f"}, {"k", "l"}}
+	for _, size := range []int{1, 50} {
+		r := NewReaderWithOptions(strings.NewReader(in), ReaderOptions{
+			ChunkSize:   size,
+			ErrorPolicy: ErrorSkip,
+		})
+		got, err := r.ReadAll()
+		r.Close()
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("chunk size %d, ErrorSkip: got %q, %v, want %q", size, got, err, want)
+		}
+
+		var lines []int
+		var raws []string
+		r = NewReaderWithOptions(strings.NewReader(in), ReaderOptions{
+			ChunkSize:   size,
+			ErrorPolicy: ErrorCallback,
+			OnError: func(raw []byte, line int, err error) error {
+				var perr *ParseError
+				if !errors.As(err, &perr) || perr.StartLine != line {
+					t.Errorf("chunk size %d: OnError called with %v for line %d", size, err, line)
+				}
+				lines = append(lines, line)
+				raws = append(raws, string(raw))
+				return nil
+			},
+		})
+		got, err = r.ReadAll()
+		r.Close()
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("chunk size %d, ErrorCallback: got %q, %v, want %q", size, got, err, want)
+		}
+		if !reflect.DeepEqual(lines, []int{2, 4, 6}) || !reflect.DeepEqual(raws, []string{"c,d\"x\n", "\"g\n\"h,i\n", "j\n"}) {
+			t.Errorf("chunk size %d: OnError called for lines %v, %q", size, lines, raws)
+		}
+
+		stop := errors.New("stop")
+		r = NewReaderWithOptions(strings.NewReader(in), ReaderOptions{
+			ChunkSize:   size,
+			ErrorPolicy: ErrorCallback,
+			OnError: func(raw []byte, line int, err error) error {
+				if line == 4 {
+					return stop
+				}
+				return nil
+			},
+		})
+		got, err = r.ReadAll()
+		r.Close()
+		if err != stop || !reflect.DeepEqual(got, want[:2]) {
+			t.Errorf("chunk size %d, stopping: got %q, %v, want %q, %v", size, got, err, want[:2], stop)
+		}
+	}
+
+	// errors that aren't about a record are never skipped
+	for _, policy := range []ErrorPolicy{ErrorAbort, ErrorSkip, ErrorCallback} {
+		r := NewReaderWithOptions(strings.NewReader(in), ReaderOptions{
+			Comma:       '\n',
+			ErrorPolicy: policy,
+			OnError: func(raw []byte, line int, err error) error {
+				t.Errorf("policy %d: OnError called with %v for line %d", policy, err, line)
+				return nil
+			},
+		})
+		got, err := r.ReadAll()
+		r.Close()
+		var perr *csv.ParseError
+		if err == nil || errors.As(err, &perr) || len(got) != 0 {
+			t.Errorf("policy %d with a bad Comma: got %q, %v, want an error", policy, got, err)
+		}
+	}
+}
+
+func TestRejects(t *testing.T) {
+	in := "a,b\nc,d\"x\ne,f\n\"g\n\"h,i\nj\nk,l\n"
+	var rejects, report bytes.Buffer
+	r := NewReaderWithOptions(strings.NewReader(in), ReaderOptions{
+		ChunkSize:    2,
+		ErrorPolicy:  ErrorSkip,
+		Rejects:      &rejects,
+		RejectReport: &report,
+	})
+	defer r.Close()
+	if _, err := r.ReadAll(); err != nil {
+		t.Errorf("Unexpected error - %v", err)
+	}
+	if want := "c,d\"x\n\"g\n\"h,i\nj\n"; rejects.String() != want {
+		t.Errorf("Rejected %q, want %q", rejects.String(), want)
+	}
+	rows, err := csv.NewReader(&report).ReadAll()
+	if err != nil {
+		t.Fatalf("Error reading the report - %v", err)
+	}
+	var got [][]string
+	for _, row := range rows {
+		got = append(got, row[:2])
+	}
+	want := [][]string{{"line", "offset"}, {"2", "4"}, {"4", "14"}, {"6", "22"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Reported %q, want %q", got, want)
+	}
+	if !strings.Contains(rows[3][2], "wrong number of fields") {
+		t.Errorf("Reported %q as the reason for line 6", rows[3][2])
+	}
+
+	// UTF-16 input is rejected as it was, not as the UTF-8 it's read as
+	for _, enc := range []Encoding{UTF16LE, UTF16BE} {
+		in := append(appendEncoded(nil, []byte("\ufeff"), enc), appendEncoded(nil, []byte("a,b\nc,d\"\u00e9\U0001F600\ne,f\n"), enc)...)
+		rejects.Reset()
+		r := NewReaderWithOptions(bytes.NewReader(in), ReaderOptions{
+			ErrorPolicy: ErrorSkip,
+			Rejects:     &rejects,
+		})
+		if _, err := r.ReadAll(); err != nil {
+			t.Errorf("Encoding %d: unexpected error - %v", enc, err)
+		}
+		r.Close()
+		if want := appendEncoded(nil, []byte("c,d\"\u00e9\U0001F600\n"), enc); !bytes.Equal(rejects.Bytes(), want) {
+			t.Errorf("Encoding %d: rejected %q, want %q", enc, rejects.Bytes(), want)
+		}
+	}
+}
+
+func TestReaderAt(t *testing.T) {
+	var in bytes.Buffer
+	in.WriteString("name,quote\n")
+	for x := 0; x < 300; x++ {
+		switch x % 5 {
+		case 0:
+			fmt.Fprintf(&in, "%d,\"multi\nline, \"\"quoted\"\"\n\"\n", x)
+		case 1:
+			fmt.Fprintf(&in, "%d,plain\r\n\r\n", x)
+		case 2:
+			fmt.Fprintf(&in, "\n%d,\"\"\n", x)
+		default:
+			fmt.Fprintf(&in, "%d,\"\"\"\n\"\"\"\n", x)
+		}
+	}
+	in.WriteString("last,\"no newline\"")
+	want, err := csv.NewReader(bytes.NewReader(in.Bytes())).ReadAll()
+	if err != nil {
+		t.Fatalf("Error reading with encoding/csv - %v", err)
+	}
+	for _, size := range []int64{1, 2, 7, 64, defaultRangeSize} {
+		r := OldNewReaderAt(bytes.NewReader(in.Bytes()), int64(in.Len()))
+		r.rangeSize = size
+		got, err := r.ReadAll()
+		r.Close()
+		if err != nil {
+			t.Errorf("range size %d: unexpected error %v", size, err)
+		} else if !reflect.DeepEqual(got, want) {
+			t.Errorf("range size %d: got %d records, want %d", size, len(got), len(want))
+		}
+
+		r = OldNewReaderAt(bytes.NewReader(in.Bytes()), int64(in.Len()))
+		r.rangeSize = size
+		r.UseHeader = true
+		got, err = r.ReadAll()
+		r.Close()
+		if err != nil {
+			t.Errorf("range size %d with header: unexpected error %v", size, err)
+		} else if !reflect.DeepEqual(got, want[1:]) {
+			t.Errorf("range size %d with header: got %d records, want %d", size, len(got), len(want)-1)
+		}
+	}
+
+	// ChunkBytes sets the size of the ranges, so a batch can't hold them all
+	r := NewReaderAt(bytes.NewReader(in.Bytes()), int64(in.Len()), ReaderOptions{ChunkBytes: 64})
+	batch, err := r.ReadBatch()
+	if err != nil || len(batch) == 0 || len(batch) >= len(want)/2 {
+		t.Errorf("ReadBatch with ChunkBytes returned %d records and %v", len(batch), err)
+	}
+	got, err := r.ReadAll()
+	r.Close()
+	if err != nil || !reflect.DeepEqual(append(batch, got...), want) {
+		t.Errorf("ChunkBytes: got %d records and %v, want %d", len(batch)+len(got), err, len(want))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r = NewReaderAtContext(ctx, bytes.NewReader(in.Bytes()), int64(in.Len()), ReaderOptions{})
+	if _, err := r.Read(); err != context.Canceled {
+		t.Errorf("Read with a done context returned %v, want %v", err, context.Canceled)
+	}
+	r.Close()
+
+	bad := "a,b\n\"c\nd\",e\nf,g\"h\n"
+	for _, size := range []int64{1, 5, defaultRangeSize} {
+		r := OldNewReaderAt(strings.NewReader(bad), int64(len(bad)))
+		r.rangeSize = size
+		_, err := r.ReadAll()
+		r.Close()
+		var perr *csv.ParseError
+		if !errors.As(err, &perr) || perr.Line != 4 {
+			t.Errorf("range size %d: error %v, want a parse error on line 4", size, err)
+		}
+	}
+}
+
+func TestOpen(t *testing.T) {
+	var in bytes.Buffer
+	in.WriteString("id,text\n")
+	for x := 0; x < 5000; x++ {
+		fmt.Fprintf(&in, "%d,\"line %d\n\"\"continued\"\"\"\n", x, x)
+	}
+	path := filepath.Join(t.TempDir(), "test.csv")
+	if err := os.WriteFile(path, in.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	want, err := csv.NewReader(bytes.NewReader(in.Bytes())).ReadAll()
+	if err != nil {
+		t.Fatalf("Error reading with encoding/csv - %v", err)
+	}
+	r, err := Open(path, ReaderOptions{ChunkBytes: 4096})
+	if err != nil {
+		t.Fatalf("Error opening %s - %v", path, err)
+	}
+	got, err := r.ReadAll()
+	if err != nil {
+		t.Errorf("Unexpected error - %v", err)
+	} else if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %d records, want %d", len(got), len(want))
+	}
+	if err := r.mcr.Close(); err != nil {
+		t.Errorf("Error closing - %v", err)
+	}
+
+	// closing part way through has to wait for the goroutines using the mapping
+	r, err = Open(path, ReaderOptions{ChunkBytes: 512})
+	if err != nil {
+		t.Fatalf("Error opening %s - %v", path, err)
+	}
+	if _, err := r.Read(); err != nil {
+		t.Fatalf("Unexpected error - %v", err)
+	}
+	if err := r.mcr.Close(); err != nil {
+		t.Errorf("Error closing - %v", err)
+	}
+	// the records left to return were in the mapping
+	if _, err := r.Read(); err != ErrReaderClosed {
+		t.Errorf("Read after Close returned %v, want %v", err, ErrReaderClosed)
+	}
+
+	// nor can a Stream still being read from
+	r, err = Open(path, ReaderOptions{ChunkBytes: 512})
+	if err != nil {
+		t.Fatalf("Error opening %s - %v", path, err)
+	}
+	out, errChan := r.Stream()
+	for x := 0; x < 5; x++ {
+		<-out
+	}
+	r.Close()
+	for range out {
+	}
+	if err := <-errChan; err != ErrReaderClosed {
+		t.Errorf("Stream after Close returned %v, want %v", err, ErrReaderClosed)
+	}
+
+	if _, err := Open(filepath.Join(t.TempDir(), "missing.csv"), ReaderOptions{}); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Opening a missing file returned %v", err)
+	}
+}
+
+func TestUnordered(t *testing.T) {
+	var in bytes.Buffer
+	want := make(map[int][]string)
+	line := 1
+	for x := 0; x < 2000; x++ {
+		want[line] = []string{fmt.Sprint(x), "a,b"}
+		fmt.Fprintf(&in, "%d,\"a,b\"\n", x)
+		line++
+	}
+	r := NewReaderWithOptions(bytes.NewReader(in.Bytes()), ReaderOptions{
+		ChunkSize: 7,
+		Unordered: true,
+	})
+	defer r.Close()
+	got := make(map[int][]string)
+	for {
+		record, err := r.ReadRecord()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error - %v", err)
+		}
+		got[record.Line] = record.Fields
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %d records by line, want %d", len(got), len(want))
+	}
+}
+
+// testCSV returns the CSV made of n records from record, along with what
+// encoding/csv reads from it
+func testCSV(t *testing.T, n int, record func(x int) string) ([]byte, [][]string) {
+	t.Helper()
+	var in bytes.Buffer
+	for x := 0; x < n; x++ {
+		in.WriteString(record(x))
+	}
+	want, err := csv.NewReader(bytes.NewReader(in.Bytes())).ReadAll()
+	if err != nil {
+		t.Fatalf("Error reading with encoding/csv - %v", err)
+	}
+	return in.Bytes(), want
+}
+
+// quotedNewline is a record for testCSV with a newline in a quoted field
+func quotedNewline(x int) string {
+	return fmt.Sprintf("%d,\"a\nb\"\n", x)
+}
+
+func TestReadBatch(t *testing.T) {
+	in, want := testCSV(t, 1000, func(x int) string {
+		if x%10 == 0 {
+			return quotedNewline(x) + "\n"
+		}
+		return quotedNewline(x)
+	})
+	r := NewReader(bytes.NewReader(in), 30)
+	var got [][]string
+	for {
+		batch, err := r.ReadBatch()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error - %v", err)
+		}
+		if len(batch) == 0 || len(batch) > 30 {
+			t.Errorf("Got a batch of %d records", len(batch))
+		}
+		got = append(got, batch...)
+	}
+	r.Close()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %d records, want %d", len(got), len(want))
+	}
+
+	r = NewReader(bytes.NewReader(in), 30)
+	out, errChan := r.StreamBatches()
+	got = nil
+	for batch := range out {
+		got = append(got, batch...)
+	}
+	if err := <-errChan; err != nil {
+		t.Errorf("Unexpected error - %v", err)
+	}
+	r.Close()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Streamed %d records, want %d", len(got), len(want))
+	}
+
+	r = NewReaderWithOptions(strings.NewReader("a,b\nc,d\ne\nf,g\n"), ReaderOptions{ChunkSize: 10})
+	defer r.Close()
+	for _, tt := range []struct {
+		Output [][]string
+		Error  error
+	}{
+		{Output: [][]string{{"a", "b"}, {"c", "d"}}},
+		{Output: [][]string{{"e"}}, Error: csv.ErrFieldCount},
+		{Output: [][]string{{"f", "g"}}},
+		{Error: io.EOF},
+	} {
+		batch, err := r.ReadBatch()
+		if !reflect.DeepEqual(batch, tt.Output) || !errors.Is(err, tt.Error) {
+			t.Errorf("ReadBatch returned %q, %v, want %q, %v", batch, err, tt.Output, tt.Error)
+		}
+	}
+}
+
+func TestMaxInFlight(t *testing.T) {
+	in, want := testCSV(t, 1000, quotedNewline)
+	for _, max := range []int{1, 2, 5} {
+		r := OldNewReaderSized(bytes.NewReader(in), 3)
+		r.MaxInFlight = max
+		var got [][]string
+		for {
+			record, err := r.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error - %v", err)
+			}
+			if len(r.queue) > max {
+				t.Errorf("MaxInFlight %d: %d chunks queued", max, len(r.queue))
+			}
+			got = append(got, record)
+		}
+		r.Close()
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("MaxInFlight %d: got %d records, want %d", max, len(got), len(want))
+		}
+
+		var out bytes.Buffer
+		w := NewWriterSized(&out, 3)
+		w.MaxInFlight = max
+		if err := w.WriteAll(want); err != nil {
+			t.Errorf("MaxInFlight %d: error writing - %v", max, err)
+		}
+		if err := w.Close(); err != nil {
+			t.Errorf("MaxInFlight %d: error closing writer - %v", max, err)
+		}
+		if !bytes.Equal(out.Bytes(), in) {
+			t.Errorf("MaxInFlight %d: wrote %d bytes, want %d", max, out.Len(), len(in))
+		}
+	}
+}
+
+func TestMaxInFlightHeader(t *testing.T) {
+	// the chunks of comments before the header mustn't use up the chunks in
+	// flight, nothing returns them until Header does
+	r := NewReaderWithOptions(strings.NewReader("# one\n# two\nname,email\nrob,rob@example.com\n"), ReaderOptions{
+		Comment:     '#',
+		UseHeader:   true,
+		ChunkSize:   1,
+		MaxInFlight: 1,
+	})
+	defer r.Close()
+	header, err := r.Header()
+	if err != nil || !reflect.DeepEqual(header, []string{"name", "email"}) {
+		t.Fatalf("Header returned %q, %v", header, err)
+	}
+	record, err := r.ReadRecord()
+	if err != nil || record.Get("email") != "rob@example.com" {
+		t.Errorf("ReadRecord returned %q, %v", record.Fields, err)
+	}
+	if _, err := r.ReadRecord(); err != io.EOF {
+		t.Errorf("ReadRecord returned %v at the end, want %v", err, io.EOF)
+	}
+}
+
+func TestWorkers(t *testing.T) {
+	in, want := testCSV(t, 1000, quotedNewline)
+	for _, workers := range []int{1, 3, 8} {
+		b := newBusy(workers)
+		r := NewReaderWithOptions(bytes.NewReader(in), ReaderOptions{
+			ChunkSize: 25,
+			Workers:   workers,
+		})
+		err := r.mcr.setTransform(func(record []string) (interface{}, error) {
+			x, _ := strconv.Atoi(record[0])
+			b.run(x)
+			return nil, nil
+		}, false)
+		if err != nil {
+			t.Fatalf("Unexpected error - %v", err)
+		}
+		got, err := r.ReadAll()
+		r.Close()
+		if err != nil {
+			t.Errorf("%d workers: unexpected error - %v", workers, err)
+		} else if !reflect.DeepEqual(got, want) {
+			t.Errorf("%d workers: got %d records, want %d", workers, len(got), len(want))
+		}
+		if most := b.most.Load(); most != int32(workers) {
+			t.Errorf("%d workers: %d chunks were parsed at once", workers, most)
+		}
+
+		b = newBusy(workers)
+		var out bytes.Buffer
+		w := NewWriterSized(&out, 25)
+		w.Workers = workers
+		w.marshal = func(v interface{}) ([]string, error) {
+			b.run(v.(int))
+			return want[v.(int)], nil
+		}
+		for x := range want {
+			if err := w.write(nil, x); err != nil {
+				t.Errorf("%d workers: error writing - %v", workers, err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Errorf("%d workers: error closing writer - %v", workers, err)
+		}
+		if !bytes.Equal(out.Bytes(), in) {
+			t.Errorf("%d workers: wrote %d bytes, want %d", workers, out.Len(), len(in))
+		}
+		if most := b.most.Load(); most != int32(workers) {
+			t.Errorf("%d workers: %d chunks were encoded at once", workers, most)
+		}
+	}
+}
+
+// busy counts how many goroutines are running it at once
+type busy struct {
+	workers      int32
+	deadline     time.Time // when to stop waiting for workers goroutines
+	active, most atomic.Int32
+}
+
+func newBusy(workers int) *busy {
+	return &busy{
+		workers:  int32(workers),
+		deadline: time.Now().Add(time.Second),
+	}
+}
+
+// run is called for each record with its number, for the first record of
+// each chunk of 25 it waits for workers goroutines to be running it
+func (b *busy) run(x int) {
+	n := b.active.Add(1)
+	defer b.active.Add(-1)
+	for m := b.most.Load(); n > m && !b.most.CompareAndSwap(m, n); m = b.most.Load() {
+	}
+	for x%25 == 0 && b.most.Load() < b.workers && time.Now().Before(b.deadline) {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestAdaptiveChunks(t *testing.T) {
+	in, want := testCSV(t, 20000, func(x int) string {
+		return fmt.Sprintf("%d,\"a\nb\",%s\n", x, strings.Repeat("c", x%100))
+	})
+	r := NewReaderWithOptions(bytes.NewReader(in), ReaderOptions{
+		AdaptiveChunks: true,
+	})
+	got, err := r.ReadAll()
+	r.Close()
+	if err != nil {
+		t.Errorf("Unexpected error - %v", err)
+	} else if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %d records, want %d", len(got), len(want))
+	}
+
+	ct := newChunkTuner()
+	ct.observe(1<<30, time.Millisecond)
+	if got := ct.size(); got != maxChunkBytes {
+		t.Errorf("Fast parsing sized chunks at %d bytes, want %d", got, maxChunkBytes)
+	}
+	for x := 0; x < 100; x++ {
+		ct.observe(1, time.Second)
+	}
+	if got := ct.size(); got != minChunkBytes {
+		t.Errorf("Slow parsing sized chunks at %d bytes, want %d", got, minChunkBytes)
+	}
+}
+
+func TestChunkBytes(t *testing.T) {
+	in, want := testCSV(t, 100, func(x int) string {
+		return fmt.Sprintf("%03d,%s\n", x, strings.Repeat("a", 995)) // 1000 bytes
+	})
+	r := NewReaderWithOptions(bytes.NewReader(in), ReaderOptions{
+		ChunkBytes: 2500,
+	})
+	var got [][]string
+	for {
+		batch, err := r.ReadBatch()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error - %v", err)
+		}
+		if len(batch) != 3 && len(got) != 99 {
+			t.Errorf("Got a batch of %d records, want 3", len(batch))
+		}
+		got = append(got, batch...)
+	}
+	r.Close()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %d records, want %d", len(got), len(want))
+	}
+
+	var out bytes.Buffer
+	w := NewWriter(&out)
+	w.ChunkBytes = 2500
+	if err := w.WriteAll(want); err != nil {
+		t.Errorf("Error writing - %v", err)
+	}
+	if w.place < 100/3 {
+		t.Errorf("Wrote %d chunks, want at least %d", w.place, 100/3)
+	}
+	if err := w.Close(); err != nil {
+		t.Errorf("Error closing writer - %v", err)
+	}
+	if !bytes.Equal(out.Bytes(), in) {
+		t.Errorf("Wrote %d bytes, want %d", out.Len(), len(in))
+	}
+}
+
+// bgzf compresses data as BGZF blocks of at most size bytes
+func bgzf(t *testing.T, data []byte, size int) []byte {
+	var out bytes.Buffer
+	for len(data) > 0 {
+		n := size
+		if n > len(data) {
+			n = len(data)
+		}
+		var block bytes.Buffer
+		zw := gzip.NewWriter(&block)
+		zw.Extra = []byte{'B', 'C', 2, 0, 0, 0}
+		if _, err := zw.Write(data[:n]); err != nil {
+			t.Fatal(err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		b := block.Bytes()
+		b[16], b[17] = byte(len(b)-1), byte((len(b)-1)>>8)
+		out.Write(b)
+		data = data[n:]
+	}
+	return out.Bytes()
+}
+
+func TestDecompress(t *testing.T) {
+	in, want := testCSV(t, 1000, quotedNewline)
+	var gz bytes.Buffer
+	for _, part := range [][]byte{in[:1000], in[1000:]} {
+		zw := gzip.NewWriter(&gz) // one member each
+		zw.Write(part)
+		zw.Close()
+	}
+	path := filepath.Join(t.TempDir(), "test.csv.gz")
+	if err := os.WriteFile(path, gz.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for name, compressed := range map[string][]byte{
+		"gzip": gz.Bytes(),
+		"BGZF": bgzf(t, in, 100),
+	} {
+		r := OldNewReaderSized(bytes.NewReader(compressed), 7)
+		got, err := r.ReadAll()
+		r.Close()
+		if err != nil {
+			t.Errorf("%s: unexpected error - %v", name, err)
+		} else if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %d records, want %d", name, len(got), len(want))
+		}
+	}
+	opened, err := Open(path, ReaderOptions{})
+	if err != nil {
+		t.Fatalf("Error opening %s - %v", path, err)
+	}
+	got, err := opened.ReadAll()
+	opened.Close()
+	if err != nil {
+		t.Errorf("Open: unexpected error - %v", err)
+	} else if !reflect.DeepEqual(got, want) {
+		t.Errorf("Open: got %d records, want %d", len(got), len(want))
+	}
+
+	bz := []byte{
+		0x42, 0x5a, 0x68, 0x39, 0x31, 0x41, 0x59, 0x26, 0x53, 0x59, 0x14, 0x7e, 0xba, 0x96, 0x00, 0x00,
+		0x03, 0xd1, 0x00, 0x00, 0x10, 0x10, 0x04, 0x3e, 0x00, 0x20, 0x00, 0x22, 0x0d, 0x34, 0xda, 0x84,
+		0x30, 0x21, 0x90, 0x64, 0x42, 0x4b, 0xc5, 0xdc, 0x91, 0x4e, 0x14, 0x24, 0x05, 0x1f, 0xae, 0xa5,
+		0x80,
+	}
+	r := OldNewReader(bytes.NewReader(bz))
+	got, err = r.ReadAll()
+	r.Close()
+	if want := [][]string{{"a", "b"}, {"c\nd", "e"}}; err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("bzip2: got %q, %v, want %q", got, err, want)
+	}
+
+	r = OldNewReader(bytes.NewReader(gz.Bytes()))
+	r.DisableDecompression = true
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	if got, _ = r.ReadAll(); reflect.DeepEqual(got, want) {
+		t.Error("DisableDecompression: the input was decompressed")
+	}
+	r.Close()
+
+	r = OldNewReader(bytes.NewReader([]byte{0x28, 0xb5, 0x2f, 0xfd, 0, 0, 0, 0}))
+	if _, err = r.ReadAll(); err == nil {
+		t.Error("zstd: a truncated frame should fail")
+	}
+	r.Close()
+}
+
+// members compresses data as gzip members or zstd frames of about size
+// bytes each
+func members(t *testing.T, data []byte, size int, level int, zstdFrames bool) []byte {
+	var out bytes.Buffer
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer enc.Close()
+	rng := rand.New(rand.NewSource(int64(size)))
+	for len(data) > 0 {
+		n := size/2 + rng.Intn(size)
+		if n > len(data) {
+			n = len(data)
+		}
+		if zstdFrames {
+			out.Write(enc.EncodeAll(data[:n], nil))
+		} else {
+			zw, err := gzip.NewWriterLevel(&out, level)
+			if err != nil {
+				t.Fatal(err)
+			}
+			zw.Write(data[:n])
+			zw.Close()
+		}
+		data = data[n:]
+	}
+	return out.Bytes()
+}
+
+func TestDecompressParallel(t *testing.T) {
+	// random fields don't compress much, so there are many segments, and
+	// some fields look like gzip headers that a stored member keeps as they
+	// are
+	var in bytes.Buffer
+	rng := rand.New(rand.NewSource(1))
+	for x := 0; in.Len() < 1200<<10; x++ {
+		fmt.Fprintf(&in, "%d,%x,\"%x\n\"\n", x, rng.Int63(), rng.Int63())
+		if x%500 == 0 {
+			fmt.Fprintf(&in, "%d,x,\"\x1f\x8b\x08\x00\x00\x00\x00\x00\x00\xff\"\n", x)
+		}
+	}
+	want, err := csv.NewReader(bytes.NewReader(in.Bytes())).ReadAll()
+	if err != nil {
+		t.Fatalf("Error reading with encoding/csv - %v", err)
+	}
+	var skippable bytes.Buffer
+	skippable.Write([]byte{0x50, 0x2a, 0x4d, 0x18, 3, 0, 0, 0, 'a', 'b', 'c'})
+	skippable.Write(members(t, in.Bytes(), 100<<10, 0, true))
+	single := members(t, in.Bytes(), len(in.Bytes())*2, 0, true)
+	defer func(max int) {
+		maxZstdFrame = max
+	}(maxZstdFrame)
+	maxZstdFrame = 256 << 10 // smaller than single, which is then decoded as a stream
+	for name, compressed := range map[string][]byte{
+		"gzip members":        members(t, in.Bytes(), 100<<10, gzip.DefaultCompression, false),
+		"gzip small members":  members(t, in.Bytes(), 5<<10, gzip.BestSpeed, false),
+		"gzip stored members": members(t, in.Bytes(), 300<<10, gzip.NoCompression, false),
+		"gzip one member":     members(t, in.Bytes(), len(in.Bytes())*2, gzip.BestSpeed, false),
+		"zstd frames":         members(t, in.Bytes(), 100<<10, 0, true),
+		"zstd skippable":      skippable.Bytes(),
+		"zstd one frame":      single,
+	} {
+		for _, workers := range []int{1, 4} {
+			r := NewReaderWithOptions(bytes.NewReader(compressed), ReaderOptions{Workers: workers})
+			got, err := r.ReadAll()
+			r.Close()
+			if err != nil {
+				t.Errorf("%s, %d workers: unexpected error - %v", name, workers, err)
+			} else if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s, %d workers: got %d records, want %d", name, workers, len(got), len(want))
+			}
+		}
+	}
+
+	gz := members(t, in.Bytes(), 100<<10, gzip.DefaultCompression, false)
+	for name, compressed := range map[string][]byte{
+		"truncated gzip":       gz[:len(gz)-100],
+		"gzip trailing junk":   append(gz[:len(gz):len(gz)], "junk"...),
+		"truncated zstd":       skippable.Bytes()[:skippable.Len()-100],
+		"zstd trailing junk":   append(skippable.Bytes()[:skippable.Len():skippable.Len()], "junk"...),
+		"truncated zstd frame": single[:len(single)/2],
+	} {
+		r := NewReaderWithOptions(bytes.NewReader(compressed), ReaderOptions{FieldsPerRecord: -1, LazyQuotes: true})
+		if _, err := r.ReadAll(); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+		r.Close()
+	}
+}
+
+func TestEncoding(t *testing.T) {
+	var in bytes.Buffer
+	in.WriteString("name,text\n")
+	for x := 0; x < 2000; x++ {
+		fmt.Fprintf(&in, "%d,\"caf\u00e9 \U0001f600\n\u20ac\"\n", x)
+	}
+	want, err := csv.NewReader(bytes.NewReader(in.Bytes())).ReadAll()
+	if err != nil {
+		t.Fatalf("Error reading with encoding/csv - %v", err)
+	}
+	utf8In := append(append([]byte(nil), utf8BOM...), in.Bytes()...)
+	utf16LE := appendEncoded(append([]byte(nil), utf16LEBOM...), in.Bytes(), UTF16LE)
+	utf16BE := appendEncoded(nil, in.Bytes(), UTF16BE)
+	for _, tt := range []struct {
+		Name     string
+		Input    []byte
+		Encoding Encoding
+	}{
+		{Name: "UTF-8 BOM", Input: utf8In},
+		{Name: "UTF-16LE BOM", Input: utf16LE},
+		{Name: "UTF-16BE", Input: utf16BE, Encoding: UTF16BE},
+	} {
+		for _, readerAt := range []bool{false, true} {
+			opts := ReaderOptions{UseHeader: true, Encoding: tt.Encoding}
+			var r *Reader
+			if readerAt {
+				r = NewReaderAt(bytes.NewReader(tt.Input), int64(len(tt.Input)), opts)
+			} else {
+				r = NewReaderWithOptions(bytes.NewReader(tt.Input), opts)
+			}
+			header, err := r.Header()
+			if err != nil || !reflect.DeepEqual(header, want[0]) {
+				t.Errorf("%s, ReaderAt %t: header %q, %v, want %q", tt.Name, readerAt, header, err, want[0])
+			}
+			got, err := r.ReadAll()
+			r.Close()
+			if err != nil {
+				t.Errorf("%s, ReaderAt %t: unexpected error - %v", tt.Name, readerAt, err)
+			} else if !reflect.DeepEqual(got, want[1:]) {
+				t.Errorf("%s, ReaderAt %t: got %d records, want %d", tt.Name, readerAt, len(got), len(want)-1)
+			}
+		}
+	}
+
+	for _, tt := range []struct {
+		Encoding Encoding
+		Output   []string
+	}{
+		{Encoding: Windows1252, Output: []string{"caf\u00e9", "\u20ac \u2122"}},
+		{Encoding: Latin1, Output: []string{"caf\u00e9", "\u0080 \u0099"}},
+	} {
+		r := NewReaderWithOptions(strings.NewReader("caf\xe9,\"\x80 \x99\"\n"), ReaderOptions{Encoding: tt.Encoding})
+		got, err := r.ReadAll()
+		r.Close()
+		if err != nil || !reflect.DeepEqual(got, [][]string{tt.Output}) {
+			t.Errorf("Encoding %d: got %q, %v, want %q", tt.Encoding, got, err, tt.Output)
+		}
+	}
+}
+
+func TestTerminator(t *testing.T) {
+	// encoding/csv reads the same input with \n for each terminator
+	lf := "name,text\n\n"
+	for x := 0; x < 500; x++ {
+		lf += fmt.Sprintf("%d,\"multi\nline\"\n", x)
+	}
+	lf += "x,\"y\nz\"q\"\n"
+	_, err := csv.NewReader(strings.NewReader(lf)).ReadAll()
+	var want *csv.ParseError
+	if !errors.As(err, &want) {
+		t.Fatalf("encoding/csv returned %v", err)
+	}
+	records, _ := csv.NewReader(strings.NewReader(strings.TrimSuffix(lf, "x,\"y\nz\"q\"\n"))).ReadAll()
+	for _, tt := range []struct {
+		Name       string
+		Input      string
+		Terminator Terminator
+	}{
+		{Name: "LF", Input: lf},
+		{Name: "CRLF", Input: strings.ReplaceAll(lf, "\n", "\r\n")},
+		{Name: "CR", Input: strings.ReplaceAll(lf, "\n", "\r"), Terminator: CRTerminator},
+		{Name: "any", Input: strings.Replace(strings.ReplaceAll(lf, "\n", "\r"), "\r", "\r\n", 250), Terminator: AnyTerminator},
+	} {
+		for _, readerAt := range []bool{false, true} {
+			opts := ReaderOptions{ChunkSize: 7, Terminator: tt.Terminator}
+			var r *Reader
+			if readerAt {
+				r = NewReaderAt(strings.NewReader(tt.Input), int64(len(tt.Input)), opts)
+			} else {
+				r = NewReaderWithOptions(strings.NewReader(tt.Input), opts)
+			}
+			got, err := r.ReadAll()
+			r.Close()
+			var perr *ParseError
+			if !errors.As(err, &perr) {
+				t.Errorf("%s, ReaderAt %t: error %v, want a *ParseError", tt.Name, readerAt, err)
+				continue
+			}
+			if perr.StartLine != want.StartLine || perr.Line != want.Line || perr.Column != want.Column {
+				t.Errorf("%s, ReaderAt %t: error at %d-%d:%d, want %d-%d:%d", tt.Name, readerAt, perr.StartLine, perr.Line, perr.Column, want.StartLine, want.Line, want.Column)
+			}
+			if !reflect.DeepEqual(got, records) {
+				t.Errorf("%s, ReaderAt %t: got %d records, want %d", tt.Name, readerAt, len(got), len(records))
+			}
+		}
+	}
+
+	// a line that starts with \r is data unless \r ends lines
+	for _, in := range []string{"a,b\n\rc,d\n", "a,b\r\n\rc,d\r\n"} {
+		want, _ := csv.NewReader(strings.NewReader(in)).ReadAll()
+		r := NewReader(strings.NewReader(in), 1)
+		got, err := r.ReadAll()
+		r.Close()
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("%q: got %q, %v, want %q", in, got, err, want)
+		}
+	}
+}
+
 func TestClose(t *testing.T) {
 	ir := &infiniteReader{
 		data: data,
@@ -334,15 +1499,39 @@ func TestClose(t *testing.T) {
 	}
 }
 
+func TestReadContext(t *testing.T) {
+	ir := &infiniteReader{
+		data: data,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	reader := OldNewReaderContext(ctx, ir, 50)
+	reader.Comma = '\t'
+	_, err := reader.Read() // start the process
+	if err != nil {
+		t.Errorf("Error reading from stream - %v", err)
+	}
+	cancel()
+	if _, err = reader.Read(); err != context.Canceled {
+		t.Errorf("Read after cancel returned %v, want %v", err, context.Canceled)
+	}
+	reader.Close()
+
+	r := NewReaderContext(ctx, strings.NewReader("a,b\n"), ReaderOptions{})
+	if _, err = r.Read(); err != context.Canceled {
+		t.Errorf("Read with a done context returned %v, want %v", err, context.Canceled)
+	}
+	r.Close()
+}
+
 func TestReadWrite(t *testing.T) {
-	sourceLine := []string{"a", "b", "c"}
+	sourceLines := [][]string{{"a", "b", "c"}, {"d", "e\nf", "g"}}
 	lengths := []int{1, 5, 20, 50, 450, 700, 1030}
 	var source [][]string
 	var buf bytes.Buffer
 	for _, x := range lengths {
 		source = source[:0]
 		for y := 0; y < x; y++ {
-			source = append(source, sourceLine)
+			source = append(source, sourceLines[y%len(sourceLines)])
 		}
 		buf.Reset()
 		w := NewWriter(&buf)
@@ -369,6 +1558,130 @@ func TestReadWrite(t *testing.T) {
 	}
 }
 
+func TestPipe(t *testing.T) {
+	var in, want bytes.Buffer
+	for x := 0; x < 1000; x++ {
+		fmt.Fprintf(&in, "%d,b\n", x)
+		if x%3 != 0 {
+			fmt.Fprintf(&want, "b,%d\n", x)
+		}
+	}
+	swap := func(record []string) ([]string, bool, error) {
+		n, err := strconv.Atoi(record[0])
+		if err != nil {
+			return nil, false, err
+		}
+		return []string{record[1], record[0]}, n%3 != 0, nil
+	}
+	var out bytes.Buffer
+	r := NewReader(bytes.NewReader(in.Bytes()), 7)
+	w := NewWriter(&out)
+	if err := Pipe(r, w, swap); err != nil {
+		t.Errorf("Unexpected error - %v", err)
+	}
+	r.Close()
+	if err := w.Close(); err != nil {
+		t.Errorf("Error closing writer - %v", err)
+	}
+	if out.String() != want.String() {
+		t.Errorf("Pipe wrote %d bytes, want %d", out.Len(), want.Len())
+	}
+
+	out.Reset()
+	r = NewReader(strings.NewReader("1,a\n2,b\nthree,c\n4,d\n"), 1)
+	w = NewWriter(&out)
+	err := Pipe(r, w, swap)
+	var re *RecordError
+	if !errors.As(err, &re) || re.Line != 3 {
+		t.Errorf("Pipe returned %v, want a *RecordError on line 3", err)
+	}
+	r.Close()
+	w.Close()
+	if out.String() != "a,1\nb,2\n" {
+		t.Errorf("Pipe wrote %q before the error", out.String())
+	}
+
+	out.Reset()
+	r = NewReaderWithOptions(strings.NewReader("n,letter\n1,a\n3,c\n4,d\n"), ReaderOptions{UseHeader: true})
+	w = NewWriter(&out)
+	if err := Pipe(r, w, swap); err != nil {
+		t.Errorf("Unexpected error - %v", err)
+	}
+	r.Close()
+	w.Close()
+	if out.String() != "n,letter\na,1\nd,4\n" {
+		t.Errorf("Pipe with a header wrote %q", out.String())
+	}
+
+	r = NewReaderWithOptions(strings.NewReader("n,letter\n1,a\n"), ReaderOptions{UseHeader: true})
+	if _, err := r.Header(); err != nil {
+		t.Fatalf("Unexpected error - %v", err)
+	}
+	w = NewWriter(&out)
+	if err := Pipe(r, w, swap); err != ErrReaderStarted {
+		t.Errorf("Pipe after Header returned %v, want %v", err, ErrReaderStarted)
+	}
+	r.Close()
+	w.Close()
+}
+
+func TestReader(t *testing.T) {
+	in := "a,\"b\nc\",d\ne,f\n\ng,\"h \"i\" j\"\n" + string(data)
+	expected := csv.NewReader(strings.NewReader(in))
+	expected.LazyQuotes = true
+	expected.FieldsPerRecord = -1
+	want, err := expected.ReadAll()
+	if err != nil {
+		t.Fatalf("Error reading with encoding/csv - %v", err)
+	}
+	for _, size := range []int{0, 1, 7, 50} {
+		r := NewReader(strings.NewReader(in), size)
+		got, err := r.ReadAll()
+		r.Close()
+		if err != nil {
+			t.Errorf("size %d: unexpected error %v", size, err)
+		} else if !reflect.DeepEqual(got, want) {
+			t.Errorf("size %d: got %d records, want %d", size, len(got), len(want))
+		}
+	}
+}
+
+func TestReaderWithOptions(t *testing.T) {
+	tests := []struct {
+		Name  string
+		Input string
+		Opts  ReaderOptions
+		Error string
+	}{
+		{Name: "Semicolon", Input: "a;b\n#c;d\ne;\"f\ng\"\n", Opts: ReaderOptions{Comma: ';'}},
+		{Name: "Tab", Input: "a\tb\n#c\td\n", Opts: ReaderOptions{Comma: '\t', Comment: '#'}},
+		{Name: "TrimLeadingSpace", Input: "a, \"b\nc\"\n", Opts: ReaderOptions{TrimLeadingSpace: true}},
+		{Name: "ReuseRecord", Input: "a,b\nc,d\ne,f\n", Opts: ReaderOptions{ReuseRecord: true, ChunkSize: 2}},
+		{Name: "StrictQuotes", Input: "a,b\"c\n", Error: `bare " in non-quoted-field`},
+	}
+	for _, tt := range tests {
+		expected := csv.NewReader(strings.NewReader(tt.Input))
+		if tt.Opts.Comma != 0 {
+			expected.Comma = tt.Opts.Comma
+		}
+		expected.Comment = tt.Opts.Comment
+		expected.TrimLeadingSpace = tt.Opts.TrimLeadingSpace
+		want, _ := expected.ReadAll()
+		r := NewReaderWithOptions(strings.NewReader(tt.Input), tt.Opts)
+		got, err := r.ReadAll()
+		r.Close()
+		if tt.Error != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.Error) {
+				t.Errorf("%s: error %v, want error %q", tt.Name, err, tt.Error)
+			}
+		} else if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.Name, err)
+		} else if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: out=%q want %q", tt.Name, got, want)
+		}
+	}
+}
+
 func benchmarkRead(b *testing.B, chunkSize int) {
 	ir := &infiniteReader{
 		data: data,
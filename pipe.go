@@ -0,0 +1,63 @@
+package multicorecsv
+
+import "io"
+
+// piped is what a record is transformed into by Pipe
+type piped struct {
+	record []string
+	keep   bool
+}
+
+// Pipe reads every record from r, transforms it with fn and writes the
+// result to w.  fn is run by r's parsing goroutines, the records are still
+// written in the order they were read.  When fn returns false the record is
+// dropped.  With UseHeader set, the header isn't passed to fn, it's written
+// to w as it is.
+//
+// Pipe stops at the first error, an error from fn is returned in a
+// *RecordError with the record's line.  The parsing goroutines have to
+// start with fn, so r must not have been read from yet, nor its Header
+// read, otherwise Pipe returns ErrReaderStarted.  Pipe flushes w, but r and
+// w still need to be closed.
+func Pipe(r *Reader, w *Writer, fn func(record []string) ([]string, bool, error)) error {
+	err := r.mcr.setTransform(func(record []string) (interface{}, error) {
+		out, keep, err := fn(record)
+		if err != nil {
+			return nil, err
+		}
+		return piped{record: out, keep: keep}, nil
+	}, false)
+	if err != nil {
+		return err
+	}
+	if r.mcr.UseHeader {
+		header, err := r.mcr.Header()
+		if err == io.EOF {
+			return nil // no records at all
+		}
+		if err != nil {
+			return err
+		}
+		if err := w.Write(header); err != nil {
+			return err
+		}
+	}
+	for {
+		line, err := r.mcr.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		p := line.value.(piped)
+		if !p.keep {
+			continue
+		}
+		if err := w.Write(p.record); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
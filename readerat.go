@@ -0,0 +1,270 @@
+package multicorecsv
+
+import (
+	"bytes"
+	"context"
+	"io"
+)
+
+const (
+	defaultRangeSize = 1 << 20 // bytes of a ReaderAt handed to each goroutine
+	readMoreSize     = 64 << 10
+)
+
+// rangeBound is what's known about the input before a range
+type rangeBound struct {
+	quotes int           // quotes before the range, only the parity matters
+	lines  int           // newlines before the range
+	done   chan struct{} // closed once quotes and lines are set
+}
+
+// OldNewReaderAt returns a new Reader that reads size bytes from r.  Instead
+// of reading r from start to finish, it's split into ranges that are read,
+// split into records and parsed concurrently.  Records are still returned in
+// order.
+//
+// The start of the first record in a range is found by counting the quotes
+// before it, so quotes may only be used around fields and escaped as "" like
+// RFC 4180 says.  Input with bare quotes, even with LazyQuotes set, or with
+// quotes in comments has to use OldNewReader.
+//
+// Each range is rangeSize bytes, or ChunkBytes when it's set.  ChunkSize and
+// AdaptiveChunks don't apply to the ranges, only to input that has to be
+// read as a stream, such as compressed input.
+func OldNewReaderAt(r io.ReaderAt, size int64) *OldReader {
+	return OldNewReaderAtContext(context.Background(), r, size)
+}
+
+// OldNewReaderAtContext is like OldNewReaderAt, but when ctx is done all of
+// the goroutines are stopped as if Close was called and Read returns
+// ctx.Err().
+func OldNewReaderAtContext(ctx context.Context, r io.ReaderAt, size int64) *OldReader {
+	var rdr io.Reader = io.NewSectionReader(r, 0, size)
+	if c, ok := r.(io.Closer); ok {
+		rdr = struct {
+			io.Reader
+			io.Closer
+		}{rdr, c}
+	}
+	mcr := OldNewReaderContext(ctx, rdr, 50)
+	mcr.rangeSize = defaultRangeSize
+	mcr.produce = func() error {
+		return mcr.startRanges(r, size)
+	}
+	return mcr
+}
+
+// startRanges hands the ranges to the parsing goroutines, they split the
+// ranges into lines themselves
+func (mcr *OldReader) startRanges(r io.ReaderAt, size int64) (err error) {
+	head := make([]byte, sniffSize)
+	n, _ := r.ReadAt(head, 0)
+	head = head[:n]
+	if (!mcr.DisableDecompression && sniff(head) != uncompressed) || mcr.isUTF16(head) ||
+		mcr.Terminator != LFTerminator {
+		return mcr.startReading() // compressed, UTF-16 or \r terminated input can't be split
+	}
+	defer close(mcr.linein)
+	var base int64
+	if mcr.Encoding == UTF8 && bytes.HasPrefix(head, utf8BOM) {
+		base = int64(len(utf8BOM))
+	}
+	line := 1
+	if mcr.UseHeader {
+		defer func() {
+			mcr.headerNotFound(err)
+		}()
+		if base, line, err = mcr.readRangeHeader(r, size, base); err != nil {
+			return err
+		}
+	}
+	rangeSize := mcr.rangeSize
+	if mcr.ChunkBytes > 0 {
+		rangeSize = int64(mcr.ChunkBytes)
+	}
+	count := int((size - base + rangeSize - 1) / rangeSize)
+	bounds := make([]rangeBound, count+1)
+	for i := range bounds {
+		bounds[i].done = make(chan struct{})
+	}
+	bounds[0].lines = line - 1
+	close(bounds[0].done)
+	for i := 0; i < count; i++ {
+		start := base + int64(i)*rangeSize
+		end := start + rangeSize
+		if end > size {
+			end = size
+		}
+		before, after := &bounds[i], &bounds[i+1]
+		chunk := rawChunk{
+			num: i,
+			load: func() ([]csvLine, error) {
+				return mcr.loadRange(r, size, base, start, end, before, after)
+			},
+		}
+		if !mcr.send(chunk) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// readRangeHeader reads the header from r, starting at base, returning the
+// offset and line number that follow it
+func (mcr *OldReader) readRangeHeader(r io.ReaderAt, size, base int64) (int64, int, error) {
+	rs := &rangeSplitter{
+		r:      r,
+		mapped: mcr.mapped,
+		size:   size,
+		from:   base,
+		qs:     mcr.newQuoteScanner(),
+	}
+	pos, line := 0, 1
+	for mcr.header == nil && !(pos == len(rs.data) && rs.atEOF()) {
+		next, newlines, err := rs.record(pos)
+		if err != nil {
+			return 0, 0, err
+		}
+		if mcr.isRecord(rs.data[pos:next]) {
+			raw := csvLine{
+				data:   rs.data[pos:next],
+				line:   line,
+				offset: base + int64(pos),
+			}
+			if err := mcr.readHeader(raw); err != nil {
+				return 0, 0, err
+			}
+		}
+		pos, line = next, line+newlines
+	}
+	return base + int64(pos), line, nil
+}
+
+// loadRange is run by a parsing goroutine to split the records starting
+// between start and end out of r.  Records that start in the range are split
+// even if they end after it.
+func (mcr *OldReader) loadRange(r io.ReaderAt, size, base, start, end int64, before, after *rangeBound) ([]csvLine, error) {
+	rs := &rangeSplitter{
+		r:      r,
+		mapped: mcr.mapped,
+		size:   size,
+		from:   start,
+		qs:     mcr.newQuoteScanner(),
+	}
+	if start > base {
+		rs.from = start - 1 // to know if start is the beginning of a line
+	}
+	if rs.mapped != nil {
+		rs.data = rs.mapped[rs.from:end]
+	} else {
+		rs.data = make([]byte, end-rs.from)
+		if _, err := r.ReadAt(rs.data, rs.from); err != nil && err != io.EOF {
+			return nil, err
+		}
+	}
+	own := rs.data[start-rs.from:]
+	quotes, newlines := bytes.Count(own, []byte{'"'}), bytes.Count(own, []byte{'\n'})
+	select {
+	case <-before.done:
+	case <-mcr.cancel:
+		return nil, nil
+	}
+	after.quotes, after.lines = before.quotes+quotes, before.lines+newlines
+	close(after.done)
+
+	pos, line := 0, before.lines+1
+	if rs.from < start {
+		// the first record starts after the first newline that isn't quoted
+		pos = -1
+		quotes := before.quotes
+		if rs.data[0] == '"' {
+			quotes--
+		}
+		for i, c := range rs.data {
+			if c == '"' {
+				quotes++
+			} else if c == '\n' && quotes%2 == 0 {
+				pos = i + 1
+				break
+			}
+		}
+		if pos < 0 {
+			return nil, nil // no record starts in this range
+		}
+		line += bytes.Count(rs.data[1:pos], []byte{'\n'})
+	}
+	var lines []csvLine
+	for stop := int(end - rs.from); pos < stop; {
+		next, newlines, err := rs.record(pos)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, csvLine{
+			data:   rs.data[pos:next],
+			line:   line,
+			offset: rs.from + int64(pos),
+		})
+		pos, line = next, line+newlines
+	}
+	return lines, nil
+}
+
+// rangeSplitter finds the records in data, which is read from r at from or
+// sliced from mapped when it's set.
+type rangeSplitter struct {
+	r      io.ReaderAt
+	mapped []byte
+	size   int64
+	from   int64
+	data   []byte
+	qs     *quoteScanner
+}
+
+func (rs *rangeSplitter) atEOF() bool {
+	return rs.from+int64(len(rs.data)) >= rs.size
+}
+
+// more reads more of r onto the end of data
+func (rs *rangeSplitter) more() error {
+	off := rs.from + int64(len(rs.data))
+	n := rs.size - off
+	if n > readMoreSize {
+		n = readMoreSize
+	}
+	if rs.mapped != nil {
+		rs.data = rs.mapped[rs.from : off+n]
+		return nil
+	}
+	grown := append(rs.data, make([]byte, n)...)
+	if _, err := rs.r.ReadAt(grown[len(rs.data):], off); err != nil && err != io.EOF {
+		return err
+	}
+	rs.data = grown
+	return nil
+}
+
+// record returns the end of the record starting at pos and the number of
+// newlines in it, reading more of r as needed
+func (rs *rangeSplitter) record(pos int) (end int, newlines int, err error) {
+	recordStart := true
+	for {
+		i := bytes.IndexByte(rs.data[pos:], '\n')
+		if i < 0 && !rs.atEOF() {
+			if err := rs.more(); err != nil {
+				return 0, 0, err
+			}
+			continue
+		}
+		next := len(rs.data)
+		if i >= 0 {
+			next = pos + i + 1
+			newlines++
+		}
+		complete := rs.qs.scan(rs.data[pos:next], recordStart)
+		recordStart = false
+		pos = next
+		if complete || (pos == len(rs.data) && rs.atEOF()) {
+			return pos, newlines, nil
+		}
+	}
+}
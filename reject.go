@@ -0,0 +1,37 @@
+package multicorecsv
+
+import (
+	"encoding/csv"
+	"strconv"
+)
+
+// reject writes a bad record to Rejects and why it's bad to RejectReport,
+// when they're set.  The report is CSV with a line, offset and reason for
+// each record, in the same order as Rejects.
+func (mcr *OldReader) reject(line sliceLine, reason error) error {
+	if mcr.Rejects != nil {
+		raw := line.raw
+		if mcr.transcoded != UTF8 {
+			raw = appendEncoded(nil, raw, mcr.transcoded)
+		}
+		if _, err := mcr.Rejects.Write(raw); err != nil {
+			return err
+		}
+	}
+	if mcr.RejectReport == nil {
+		return nil
+	}
+	if mcr.report == nil {
+		mcr.report = csv.NewWriter(mcr.RejectReport)
+		if err := mcr.report.Write([]string{"line", "offset", "reason"}); err != nil {
+			return err
+		}
+	}
+	_ = mcr.report.Write([]string{
+		strconv.Itoa(line.line),
+		strconv.FormatInt(line.offset, 10),
+		reason.Error(),
+	})
+	mcr.report.Flush() // rejects are rare, keep the report current
+	return mcr.report.Error()
+}
@@ -0,0 +1,164 @@
+package multicorecsv
+
+import (
+	"bufio"
+	"bytes"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A Terminator is what ends the lines of the input.
+type Terminator int
+
+const (
+	LFTerminator  Terminator = iota // \n or \r\n, like encoding/csv
+	CRTerminator                    // \r, as old Mac files have
+	AnyTerminator                   // \n, \r\n or a lone \r
+)
+
+// readLine returns the next line of br, including its terminator, with the
+// same errors as ReadBytes.  A \r\n is always kept together.
+func (mcr *OldReader) readLine(br *bufio.Reader) ([]byte, error) {
+	if mcr.Terminator == LFTerminator {
+		return br.ReadBytes('\n')
+	}
+	ends := "\r"
+	if mcr.Terminator == AnyTerminator {
+		ends = "\r\n"
+	}
+	var line []byte
+	for {
+		if br.Buffered() == 0 {
+			if _, err := br.Peek(1); err != nil {
+				return line, err
+			}
+		}
+		buffered, _ := br.Peek(br.Buffered())
+		i := bytes.IndexAny(buffered, ends)
+		if i < 0 {
+			line = append(line, buffered...)
+			_, _ = br.Discard(len(buffered))
+			continue
+		}
+		cr := buffered[i] == '\r'
+		line = append(line, buffered[:i+1]...)
+		_, _ = br.Discard(i + 1)
+		if cr && mcr.Terminator == AnyTerminator {
+			if next, _ := br.Peek(1); len(next) == 1 && next[0] == '\n' {
+				line = append(line, '\n')
+				_, _ = br.Discard(1)
+			}
+		}
+		return line, nil
+	}
+}
+
+// countLines returns the number of lines that data ends
+func (mcr *OldReader) countLines(data []byte) int {
+	switch mcr.Terminator {
+	case CRTerminator:
+		return bytes.Count(data, []byte{'\r'})
+	case AnyTerminator:
+		return bytes.Count(data, []byte{'\n'}) + bytes.Count(data, []byte{'\r'}) -
+			bytes.Count(data, []byte("\r\n"))
+	}
+	return bytes.Count(data, []byte{'\n'})
+}
+
+// normalizeCR turns the lone \r terminators of data into the \n that
+// encoding/csv wants, which is what it does with \r\n in quoted fields too.
+// With all, every \r is one.
+func normalizeCR(data []byte, all bool) {
+	for i := bytes.IndexByte(data, '\r'); i >= 0; i = bytes.IndexByte(data, '\r') {
+		if all || i+1 == len(data) || data[i+1] != '\n' {
+			data[i] = '\n'
+		} else {
+			i++ // skip the \n of \r\n
+		}
+		data = data[i+1:]
+	}
+}
+
+// quoteScanner follows the quoting rules of encoding/csv closely enough to
+// know whether a newline ends a record or is part of a quoted field.  It
+// doesn't validate anything, the parsing goroutines still report errors.
+type quoteScanner struct {
+	comma            rune
+	comment          rune
+	lazyQuotes       bool
+	trimLeadingSpace bool
+	loneCR           bool // true when a lone \r ends a line
+	inQuotes         bool // true when the last line ended inside a quoted field
+}
+
+func (mcr *OldReader) newQuoteScanner() *quoteScanner {
+	return &quoteScanner{
+		comma:            mcr.Comma,
+		comment:          mcr.Comment,
+		lazyQuotes:       mcr.LazyQuotes,
+		trimLeadingSpace: mcr.TrimLeadingSpace,
+		loneCR:           mcr.Terminator != LFTerminator,
+	}
+}
+
+// scan consumes one line (including its newline, if any) and reports whether
+// the record is complete at the end of it.  recordStart is true when line is
+// the first line of a record.
+func (qs *quoteScanner) scan(line []byte, recordStart bool) bool {
+	if recordStart && qs.comment != 0 && startsWithRune(line, qs.comment) {
+		return true // comments are never continued
+	}
+	fieldStart := !qs.inQuotes
+	for i := 0; i < len(line); {
+		r, size := rune(line[i]), 1
+		if r >= utf8.RuneSelf {
+			r, size = utf8.DecodeRune(line[i:])
+		}
+		switch {
+		case qs.inQuotes:
+			if r != '"' {
+				break
+			}
+			next := i + size
+			if next < len(line) && line[next] == '"' {
+				i = next + 1 // escaped quote
+				continue
+			}
+			if !qs.lazyQuotes || qs.fieldEnds(line[next:]) {
+				qs.inQuotes = false
+			}
+		case fieldStart && qs.trimLeadingSpace && r != '\n' && !qs.lineEnds(line[i:]) && unicode.IsSpace(r):
+			i += size // still looking for the start of the field
+			continue
+		case fieldStart && r == '"':
+			qs.inQuotes = true
+		}
+		fieldStart = !qs.inQuotes && r == qs.comma
+		i += size
+	}
+	return !qs.inQuotes
+}
+
+// fieldEnds reports whether rest, the bytes following a quote, would let a
+// lazily quoted field end at that quote.
+func (qs *quoteScanner) fieldEnds(rest []byte) bool {
+	if len(rest) == 0 || rest[0] == '\n' || qs.lineEnds(rest) {
+		return true
+	}
+	return startsWithRune(rest, qs.comma)
+}
+
+// lineEnds reports whether rest starts with a \r that ends the line, either
+// as part of \r\n or as a lone \r terminator.  Any other \r is just a
+// character, which TrimLeadingSpace trims like encoding/csv does.
+func (qs *quoteScanner) lineEnds(rest []byte) bool {
+	return len(rest) > 0 && rest[0] == '\r' && (qs.loneCR || len(rest) > 1 && rest[1] == '\n')
+}
+
+func startsWithRune(b []byte, r rune) bool {
+	if r < utf8.RuneSelf {
+		return len(b) > 0 && b[0] == byte(r)
+	}
+	got, _ := utf8.DecodeRune(b)
+	return got == r
+}
@@ -0,0 +1,353 @@
+package multicorecsv
+
+import (
+	"encoding"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Unmarshaler is implemented by types that can decode a CSV field into
+// themselves.
+type Unmarshaler interface {
+	UnmarshalCSV(field string) error
+}
+
+// Marshaler is implemented by types that can encode themselves as a CSV
+// field.
+type Marshaler interface {
+	MarshalCSV() (string, error)
+}
+
+var (
+	unmarshalerType     = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+	marshalerType       = reflect.TypeOf((*Marshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	textMarshalerType   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// structField is a struct field that maps to a column.
+type structField struct {
+	name       string
+	index      []int
+	omitEmpty  bool
+	def        string // used by decoding when the column is missing or empty
+	hasDefault bool
+}
+
+// typeFields returns the fields of the struct type t in order.  Exported
+// fields are named by their `csv:"name"` tag or by the field name, fields
+// tagged `csv:"-"` are skipped and the fields of embedded structs are
+// included as if they belonged to t.  The tag options are "omitempty", which
+// makes encoding write an empty field for a zero value, and "default=value",
+// which decoding uses when the column is missing or the field is empty.
+func typeFields(t reflect.Type, decoding bool) ([]structField, error) {
+	var fields []structField
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("csv")
+		if tag == "-" {
+			continue
+		}
+		if sf.Anonymous && sf.Type.Kind() == reflect.Struct && tag == "" {
+			embedded, err := typeFields(sf.Type, decoding)
+			if err != nil {
+				return nil, err
+			}
+			for _, f := range embedded {
+				f.index = append([]int{i}, f.index...)
+				fields = append(fields, f)
+			}
+			continue
+		}
+		if sf.PkgPath != "" {
+			continue // unexported
+		}
+		f := structField{
+			name:  sf.Name,
+			index: []int{i},
+		}
+		options := strings.Split(tag, ",")
+		if options[0] != "" {
+			f.name = options[0]
+		}
+		for _, option := range options[1:] {
+			switch {
+			case option == "omitempty":
+				f.omitEmpty = true
+			case strings.HasPrefix(option, "default="):
+				f.def = strings.TrimPrefix(option, "default=")
+				f.hasDefault = true
+			default:
+				return nil, fmt.Errorf("multicorecsv: unknown option %q in the tag of field %s", option, sf.Name)
+			}
+		}
+		if !supportedType(sf.Type, decoding) {
+			return nil, fmt.Errorf("multicorecsv: field %s has unsupported type %s", sf.Name, sf.Type)
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+func supportedType(t reflect.Type, decoding bool) bool {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	pt := reflect.PtrTo(t)
+	if decoding && (pt.Implements(unmarshalerType) || pt.Implements(textUnmarshalerType)) {
+		return true
+	}
+	if !decoding && (pt.Implements(marshalerType) || pt.Implements(textMarshalerType)) {
+		return true
+	}
+	switch t.Kind() {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// setField decodes s into v, which must be addressable.  An empty field
+// leaves the zero value, even for an Unmarshaler.
+func setField(v reflect.Value, s string) error {
+	if s == "" {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+	switch u := v.Addr().Interface().(type) {
+	case Unmarshaler:
+		return u.UnmarshalCSV(s)
+	case encoding.TextUnmarshaler:
+		return u.UnmarshalText([]byte(s))
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(n)
+	}
+	return nil
+}
+
+// formatField encodes v, which must be addressable
+func formatField(v reflect.Value) (string, error) {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return "", nil
+		}
+		v = v.Elem()
+	}
+	switch m := v.Addr().Interface().(type) {
+	case Marshaler:
+		return m.MarshalCSV()
+	case encoding.TextMarshaler:
+		b, err := m.MarshalText()
+		return string(b), err
+	}
+	switch v.Kind() {
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10), nil
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'g', -1, v.Type().Bits()), nil
+	}
+	return "", fmt.Errorf("multicorecsv: unsupported type %s", v.Type())
+}
+
+// A Decoder reads records from a Reader into structs.  The first record is
+// the header, columns are matched to fields by name as described by
+// typeFields and columns without a field are ignored.  The fields are
+// decoded by the Reader's parsing goroutines.
+type Decoder struct {
+	mcr     *OldReader
+	typ     reflect.Type
+	fields  []structField
+	columns []int // index of the column for each of fields, -1 when missing
+	once    sync.Once
+	err     error // why the Decoder can't be used, returned by Decode
+}
+
+// NewDecoder returns a new Decoder that reads from r into structs of the
+// type of v, a struct or a pointer to one.  The parsing goroutines need the
+// type, so r must not have been read from yet, nor its Header read.  If it
+// was, or v has an unsupported type, Decode returns the error.  Close r when
+// done.
+func NewDecoder(r *Reader, v interface{}) *Decoder {
+	d := &Decoder{
+		mcr: r.mcr,
+	}
+	t := reflect.TypeOf(v)
+	if t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		d.err = fmt.Errorf("multicorecsv: NewDecoder needs a struct, not %T", v)
+		return d
+	}
+	d.typ = t
+	if d.fields, d.err = typeFields(t, true); d.err != nil {
+		return d
+	}
+	d.err = d.mcr.setTransform(d.decode, true)
+	return d
+}
+
+// Decode reads the next record into v, which must be a pointer to the type
+// given to NewDecoder.  At the end of the input Decode returns io.EOF.  A
+// record that can't be decoded returns a *RecordError and leaves v alone,
+// the following records can still be decoded.
+func (d *Decoder) Decode(v interface{}) error {
+	if d.err != nil {
+		return d.err
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Type() != d.typ {
+		return fmt.Errorf("multicorecsv: Decode needs a non-nil *%s, not %T", d.typ, v)
+	}
+	line, err := d.mcr.next()
+	if err != nil {
+		return err
+	}
+	rv.Elem().Set(line.value.(reflect.Value).Elem())
+	return nil
+}
+
+// decode is run by the parsing goroutines
+func (d *Decoder) decode(record []string) (interface{}, error) {
+	d.once.Do(func() {
+		d.columns = make([]int, len(d.fields))
+		for i, f := range d.fields {
+			column, ok := d.mcr.columns[f.name]
+			if !ok {
+				column = -1
+			}
+			d.columns[i] = column
+		}
+	})
+	v := reflect.New(d.typ)
+	for i, f := range d.fields {
+		field := ""
+		if column := d.columns[i]; column >= 0 && column < len(record) {
+			field = record[column]
+		}
+		if field == "" && f.hasDefault {
+			field = f.def
+		}
+		if err := setField(v.Elem().FieldByIndex(f.index), field); err != nil {
+			return nil, &RecordError{Column: f.name, Err: err}
+		}
+	}
+	return v, nil
+}
+
+// An Encoder writes structs as records to a Writer.  The first call to
+// Encode writes the header.  The fields are encoded by the Writer's encoding
+// goroutines, see typeFields for how they're named.
+type Encoder struct {
+	w      *Writer
+	typ    reflect.Type
+	fields []structField
+}
+
+// NewEncoder returns a new Encoder that writes to w.  Flush and Close w when
+// done.
+func NewEncoder(w *Writer) *Encoder {
+	return &Encoder{
+		w: w,
+	}
+}
+
+// Encode writes v, a struct or a pointer to one, as a record.  Every call
+// must use the same type.  As with Writer.Write, errors encoding the fields
+// are returned by later calls or by the Writer's Error.
+func (e *Encoder) Encode(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Ptr && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return fmt.Errorf("multicorecsv: Encode needs a struct, not %T", v)
+	}
+	if e.typ == nil {
+		fields, err := typeFields(rv.Type(), false)
+		if err != nil {
+			return err
+		}
+		e.typ = rv.Type()
+		e.fields = fields
+		e.w.marshal = e.encode
+		header := make([]string, len(fields))
+		for i, f := range fields {
+			header[i] = f.name
+		}
+		if err := e.w.Write(header); err != nil {
+			return err
+		}
+	} else if e.typ != rv.Type() {
+		return fmt.Errorf("multicorecsv: Encode called with %T after %s", v, e.typ)
+	}
+	if err := e.w.Error(); err != nil {
+		return err
+	}
+	// copy it, the caller may change v before it's encoded
+	value := reflect.New(e.typ)
+	value.Elem().Set(rv)
+	return e.w.write(nil, value)
+}
+
+// encode is run by the encoding goroutines
+func (e *Encoder) encode(v interface{}) ([]string, error) {
+	rv := v.(reflect.Value).Elem()
+	record := make([]string, len(e.fields))
+	for i, f := range e.fields {
+		field := rv.FieldByIndex(f.index)
+		if f.omitEmpty && field.IsZero() {
+			continue
+		}
+		s, err := formatField(field)
+		if err != nil {
+			return nil, &RecordError{Column: f.name, Err: err}
+		}
+		record[i] = s
+	}
+	return record, nil
+}
@@ -0,0 +1,215 @@
+package multicorecsv
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type celsius float64
+
+func (c *celsius) UnmarshalCSV(field string) error {
+	f, err := strconv.ParseFloat(strings.TrimSuffix(field, "C"), 64)
+	*c = celsius(f)
+	return err
+}
+
+func (c celsius) MarshalCSV() (string, error) {
+	return strconv.FormatFloat(float64(c), 'f', 1, 64) + "C", nil
+}
+
+type audit struct {
+	Created time.Time `csv:"created"`
+}
+
+type reading struct {
+	Name     string   `csv:"name"`
+	Count    int      `csv:"count,default=1"`
+	Ratio    *float64 `csv:"ratio,omitempty"`
+	OK       bool     `csv:"ok"`
+	Temp     celsius  `csv:"temp"`
+	Ignored  string   `csv:"-"`
+	Untagged uint8
+	audit
+}
+
+func TestDecode(t *testing.T) {
+	in := "temp,name,count,ratio,ok,Untagged,created,extra\n" +
+		"21.5C,\"a\nb\",3,0.5,true,7,2020-01-02T03:04:05Z,x\n" +
+		"\n" +
+		"-1C,c,,,false,0,2021-01-02T03:04:05Z,y\n"
+	half := 0.5
+	want := []reading{
+		{Name: "a\nb", Count: 3, Ratio: &half, OK: true, Temp: 21.5, Untagged: 7, audit: audit{time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)}},
+		{Name: "c", Count: 1, Temp: -1, audit: audit{time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)}},
+	}
+	for _, size := range []int{1, 50} {
+		r := NewReaderWithOptions(strings.NewReader(in), ReaderOptions{ChunkSize: size})
+		d := NewDecoder(r, reading{})
+		var got []reading
+		for {
+			var row reading
+			err := d.Decode(&row)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("size %d: unexpected error %v", size, err)
+			}
+			got = append(got, row)
+		}
+		r.Close()
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("size %d: got %+v, want %+v", size, got, want)
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	r := NewReaderWithOptions(strings.NewReader("name,count\na,1\nb,two\n"), ReaderOptions{})
+	d := NewDecoder(r, reading{})
+	var row reading
+	if err := d.Decode(row); err == nil {
+		t.Error("Decode of a non-pointer should fail")
+	}
+	if err := d.Decode(&row); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	err := d.Decode(&row)
+	var re *RecordError
+	if !errors.As(err, &re) || re.Line != 3 || re.Column != "count" {
+		t.Errorf("error %v, want a RecordError for column count on line 3", err)
+	}
+	if err := d.Decode(&row); err != io.EOF {
+		t.Errorf("Decode after a bad record returned %v, want %v", err, io.EOF)
+	}
+	r.Close()
+
+	type unsupported struct {
+		C chan int
+	}
+	r = NewReaderWithOptions(strings.NewReader("C\n1\n"), ReaderOptions{})
+	if err := NewDecoder(r, unsupported{}).Decode(&unsupported{}); err == nil {
+		t.Error("Decode of an unsupported type should fail")
+	}
+	r.Close()
+}
+
+func TestDecodeAfterHeader(t *testing.T) {
+	var in strings.Builder
+	in.WriteString("name,count\n")
+	for x := 0; x < 2000; x++ {
+		fmt.Fprintf(&in, "%d,%d\n", x, x)
+	}
+	r := NewReaderWithOptions(strings.NewReader(in.String()), ReaderOptions{ChunkSize: 10})
+	d := NewDecoder(r, &reading{})
+	header, err := r.Header()
+	if err != nil || !reflect.DeepEqual(header, []string{"name", "count"}) {
+		t.Fatalf("Header returned %q, %v", header, err)
+	}
+	time.Sleep(50 * time.Millisecond) // let the parsing goroutines get ahead
+	rows := 0
+	for {
+		var row reading
+		err := d.Decode(&row)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if row.Name != strconv.Itoa(rows) || row.Count != rows {
+			t.Fatalf("row %d is %+v", rows, row)
+		}
+		rows++
+	}
+	r.Close()
+	if rows != 2000 {
+		t.Errorf("decoded %d rows, want 2000", rows)
+	}
+
+	r = NewReaderWithOptions(strings.NewReader(in.String()), ReaderOptions{UseHeader: true})
+	if _, err := r.Header(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := NewDecoder(r, reading{}).Decode(&reading{}); err != ErrReaderStarted {
+		t.Errorf("Decode after Header returned %v, want %v", err, ErrReaderStarted)
+	}
+	r.Close()
+}
+
+func TestEncodeDecode(t *testing.T) {
+	ratio := 1.25
+	var source []reading
+	for x := 0; x < 120; x++ {
+		row := reading{Name: strconv.Itoa(x), Count: x + 1, OK: x%2 == 0, Temp: celsius(x), Untagged: uint8(x)}
+		if x%3 == 0 {
+			row.Ratio = &ratio
+		}
+		row.Created = time.Date(2020, 1, x%28+1, 0, 0, 0, 0, time.UTC)
+		source = append(source, row)
+	}
+	var buf bytes.Buffer
+	w := NewWriterSized(&buf, 7)
+	e := NewEncoder(w)
+	for x := range source {
+		if err := e.Encode(&source[x]); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	header := "name,count,ratio,ok,temp,Untagged,created\n"
+	if !strings.HasPrefix(buf.String(), header) {
+		t.Errorf("output starts with %q, want %q", buf.String()[:len(header)], header)
+	}
+	if line := strings.Split(buf.String(), "\n")[2]; line != "1,2,,false,1.0C,1,2020-01-02T00:00:00Z" {
+		t.Errorf("second row is %q", line)
+	}
+	r := NewReaderWithOptions(&buf, ReaderOptions{ChunkSize: 3})
+	d := NewDecoder(r, reading{})
+	var got []reading
+	for {
+		var row reading
+		err := d.Decode(&row)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		got = append(got, row)
+	}
+	r.Close()
+	if !reflect.DeepEqual(got, source) {
+		t.Errorf("got %d rows back, want %d", len(got), len(source))
+	}
+}
+
+func TestEncodeAfterChunkBytes(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.ChunkBytes = 1 << 20 // the records written pile up past ChunkSize
+	for x := 0; x < 100; x++ {
+		if err := w.Write([]string{strconv.Itoa(x), "1"}); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	if err := NewEncoder(w).Encode(reading{Name: "a", Count: 2}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	lines := strings.Split(buf.String(), "\n")
+	if len(lines) != 103 || lines[99] != "99,1" || !strings.HasPrefix(lines[101], "a,2,") {
+		t.Errorf("wrote %d lines, the last %q", len(lines), lines[len(lines)-3:])
+	}
+}
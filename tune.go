@@ -0,0 +1,57 @@
+package multicorecsv
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	chunkLatency      = time.Millisecond // how long AdaptiveChunks aims for a chunk to take to parse
+	minChunkBytes     = 4 << 10
+	maxChunkBytes     = 4 << 20
+	initialChunkBytes = 64 << 10
+)
+
+// chunkTuner sizes the chunks by bytes with AdaptiveChunks.  The parsing
+// goroutines report how long each chunk took, the chunks are sized so that
+// each one takes about chunkLatency.  That's long enough that handing out
+// chunks costs little and short enough to keep all of the goroutines busy.
+type chunkTuner struct {
+	lock   sync.Mutex
+	rate   float64 // bytes parsed per second by one goroutine, a moving average
+	target int64   // the size of the next chunk, read atomically
+}
+
+func newChunkTuner() *chunkTuner {
+	return &chunkTuner{
+		target: initialChunkBytes,
+	}
+}
+
+// size returns the number of bytes to put in the next chunk
+func (ct *chunkTuner) size() int {
+	return int(atomic.LoadInt64(&ct.target))
+}
+
+// observe is called by a parsing goroutine after parsing n bytes in d
+func (ct *chunkTuner) observe(n int, d time.Duration) {
+	if n == 0 || d <= 0 {
+		return
+	}
+	rate := float64(n) / d.Seconds()
+	ct.lock.Lock()
+	defer ct.lock.Unlock()
+	if ct.rate == 0 {
+		ct.rate = rate
+	} else {
+		ct.rate = 0.8*ct.rate + 0.2*rate
+	}
+	target := int64(ct.rate * chunkLatency.Seconds())
+	if target < minChunkBytes {
+		target = minChunkBytes
+	} else if target > maxChunkBytes {
+		target = maxChunkBytes
+	}
+	atomic.StoreInt64(&ct.target, target)
+}
@@ -7,22 +7,41 @@ package multicorecsv
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/csv"
+	"errors"
 	"io"
-	"runtime"
 	"sync"
+
+	"github.com/klauspost/compress/zstd"
 )
 
+// ErrWriterClosed is returned by Write and Flush once the Writer is closed.
+var ErrWriterClosed = errors.New("multicorecsv: Writer is closed")
+
 type csvEncoded struct {
-	data *bytes.Buffer
-	num  int
+	data  *bytes.Buffer
+	num   int
+	first bool // data is the first chunk, starting with any header or BOM
 }
 
 type linesToWrite struct {
-	data [][]string
-	num  int
+	data   [][]string
+	values []interface{} // when set, the non-nil values are marshaled into data
+	num    int
+	first  bool // set for the first lines written
 }
 
+// A Compression is how Writer compresses its output.
+type Compression int
+
+const (
+	NoCompression Compression = iota
+	Gzip                      // BGZF, gzip members of at most 64 KiB that record their own size
+	Zstd                      // a zstd frame for each chunk
+)
+
 // A Writer writes records to a CSV encoded file.
 //
 // As returned by NewWriter, a Writer writes records terminated by a
@@ -32,20 +51,60 @@ type linesToWrite struct {
 // Comma is the field delimiter.
 //
 // If UseCRLF is true, the Writer ends each record with \r\n instead of \n.
+//
+// If Unordered is true, each chunk of records is written as soon as it's
+// encoded instead of in the order they were written.  The records of a chunk
+// stay in order and Flush still waits for every record written before it.
+// The first chunk, with the header from an Encoder or the BOM, is still
+// written before any other.
+//
+// MaxInFlight is the most chunks that are being encoded or waiting to be
+// written at once, 0 means there's no limit.  Once there are that many, Write
+// waits instead of letting the chunks after a slow one pile up in memory.
 type Writer struct {
 	Comma     rune // Field delimiter (set to ',' by NewWriter)
 	UseCRLF   bool // True to use \r\n as the line terminator
+	Unordered bool // True to write chunks as soon as they're encoded
 	ChunkSize int  // the # of lines to hand to each goroutine -- default 50
-	w         io.Writer
-
-	lineout    chan csvEncoded
-	linein     chan linesToWrite
-	place      int        // how many groups of ChunkSize asked to write
-	queueIn    [][]string // used to buffer lines requested to write
-	finalError error
-	//	cancel         chan struct{} // when this is closed, cancel all operations
+	// the most chunks being encoded or waiting to be written, 0 for no limit
+	MaxInFlight int
+	Workers     int // the # of encoding goroutines, GOMAXPROCS when 0
+	// If ChunkBytes is set, a chunk is handed off once its fields take at
+	// least that many bytes instead of after ChunkSize records.  The size of
+	// the structs from an Encoder isn't known until they're encoded, they're
+	// still counted by ChunkSize.
+	ChunkBytes int
+	// Compression is how the output is compressed, each chunk is compressed
+	// by the goroutine that encoded it.  Gzip output is BGZF, gzip made of
+	// members of at most 64 KiB that record their own size, and Zstd output
+	// is a frame per chunk, so that Reader can decompress either
+	// concurrently too.  Any gzip or zstd reader that handles multiple
+	// members or frames can read it.
+	Compression Compression
+	// Encoding is the character encoding of the output, it's transcoded by
+	// the encoding goroutines.  If BOM is true, the output starts with a byte
+	// order mark, as Excel wants, unless Encoding is Windows1252 or Latin1.
+	Encoding Encoding
+	BOM      bool
+	w        io.Writer
+
+	lineout        chan csvEncoded
+	linein         chan linesToWrite
+	place          int                                   // how many groups of ChunkSize asked to write
+	queueIn        [][]string                            // used to buffer lines requested to write
+	queueVals      []interface{}                         // values to marshal for queueIn, nil until one is written
+	queueBytes     int                                   // the size of the fields in queueIn
+	firstSent      bool                                  // set once the first lines are sent
+	marshal        func(v interface{}) ([]string, error) // run on values by the encoding goroutines
+	closed         bool                                  // set by Close, guarded by lock
+	inFlight       chan struct{}                         // holds a value for each chunk sent but not written, nil without MaxInFlight
+	finalError     error                                 // the first error writing to w, guarded by errLock
+	errLock        sync.Mutex
+	ctx            context.Context
+	cancel         chan struct{} // when this is closed, cancel all operations
+	cancelOnce     sync.Once
+	startOnce      sync.Once
 	closeOnce      sync.Once
-	errChan        chan error
 	flushOperation chan struct{} // value is sent when Flush operation completes
 	bufPool        sync.Pool
 	lock           sync.Mutex
@@ -58,13 +117,22 @@ func NewWriter(iow io.Writer) *Writer {
 
 // NewWriter returns a new Writer that writes to w with a specific chunkSize.  Must call Close when done.
 func NewWriterSized(iow io.Writer, chunkSize int) *Writer {
+	return NewWriterContext(context.Background(), iow, chunkSize)
+}
+
+// NewWriterContext returns a new Writer that writes to w with a specific
+// chunkSize.  When ctx is done the encoding goroutines are stopped, any
+// records not yet written are dropped and Write returns ctx.Err().  Must call
+// Close when done.
+func NewWriterContext(ctx context.Context, iow io.Writer, chunkSize int) *Writer {
 	w := &Writer{
-		Comma:   ',',
-		w:       iow,
-		lineout: make(chan csvEncoded, chunkSize),
-		linein:  make(chan linesToWrite, chunkSize),
-		queueIn: make([][]string, 0, chunkSize),
-		//		cancel:    make(chan struct{}),
+		Comma:     ',',
+		w:         iow,
+		lineout:   make(chan csvEncoded, chunkSize),
+		linein:    make(chan linesToWrite, chunkSize),
+		queueIn:   make([][]string, 0, chunkSize),
+		ctx:       ctx,
+		cancel:    make(chan struct{}),
 		ChunkSize: chunkSize, // sane default
 		bufPool: sync.Pool{
 			New: func() interface{} {
@@ -72,141 +140,345 @@ func NewWriterSized(iow io.Writer, chunkSize int) *Writer {
 			},
 		},
 		flushOperation: make(chan struct{}),
-		errChan:        make(chan error),
 	}
-	go func() {
-		var wg sync.WaitGroup
-		wg.Add(runtime.NumCPU())
-		for x := 0; x < runtime.NumCPU(); x++ {
-			go w.startEncoding(&wg)
-		}
-		go w.startWriting()
+	return w
+}
+
+// start starts the goroutines on the first send, so that Workers can be set
+// after NewWriter
+func (mcw *Writer) start() {
+	mcw.startOnce.Do(func() {
+		n := workers(mcw.Workers)
 		go func() {
-			w.finalError = <-w.errChan
-			//				log.Printf("Received error - %v", w.finalError)
-			_ = w.Close()
+			var wg sync.WaitGroup
+			wg.Add(n)
+			for x := 0; x < n; x++ {
+				go mcw.startEncoding(&wg)
+			}
+			go mcw.startWriting()
+			go func() {
+				select {
+				case <-mcw.ctx.Done():
+					mcw.stop()
+				case <-mcw.cancel:
+				}
+			}()
+			wg.Wait()
+			close(mcw.lineout)
 		}()
-		wg.Wait()
-		close(w.lineout)
-	}()
-	return w
+	})
 }
 
-// Close closes the underlying io.Writer if it's also an io.Closer as well as
-// cleaning up all goroutines
+// stop cancels all operations, unblocking every goroutine
+func (mcw *Writer) stop() {
+	mcw.cancelOnce.Do(func() {
+		close(mcw.cancel)
+	})
+}
+
+// Close flushes any buffered data and closes the underlying io.Writer if it's
+// also an io.Closer as well as cleaning up all goroutines.  The first error
+// from writing the data is returned before any error from closing.
 func (mcw *Writer) Close() error {
 	mcw.closeOnce.Do(func() {
 		mcw.Flush()
+		if mcw.Compression == Gzip && mcw.Error() == nil {
+			// everything's written, it's safe to write to w directly
+			_, err := mcw.w.Write(bgzfEOF)
+			mcw.setError(err)
+		}
+		mcw.lock.Lock()
+		mcw.closed = true
 		close(mcw.linein)
-		go func() {
-			for {
-				if _, ok := <-mcw.lineout; !ok {
-					//					log.Printf("Throwing away lineout - %q", lineout)
-					// read them all so that the encoders can die
-					return
-				}
-			}
-		}()
+		mcw.lock.Unlock()
+		mcw.stop() // everything was flushed, let the encoders die
 		if closer, ok := mcw.w.(io.Closer); ok {
-			mcw.finalError = closer.Close()
+			mcw.setError(closer.Close())
 		}
 	})
-	return mcw.finalError
+	return mcw.Error()
 }
 
 // Writer writes a single CSV record to w along with any necessary quoting.
 // A record is a slice of strings with each string being one field.
+// Records are buffered and written in the background, so an error writing
+// to w is returned by the next call to Write after it happens.
 func (mcw *Writer) Write(record []string) (err error) {
+	if err := mcw.Error(); err != nil {
+		return err
+	}
 	if len(record) == 0 {
 		return nil // done!
 	}
-	return mcw.write(record)
+	return mcw.write(record, nil)
 }
-func (mcw *Writer) write(record []string) (err error) {
+
+// write queues either record or value, which is marshaled by the encoding
+// goroutines.  When both are nil, a Flush is requested.
+func (mcw *Writer) write(record []string, value interface{}) (err error) {
 	mcw.lock.Lock()
-	if len(mcw.queueIn) == mcw.ChunkSize || len(record) == 0 { // 0 len == Flush
+	defer mcw.lock.Unlock()
+	if mcw.closed {
+		return ErrWriterClosed
+	}
+	flush := len(record) == 0 && value == nil
+	if mcw.chunkFull() || (flush && len(mcw.queueIn) > 0) {
 		//		log.Printf("Sending records for encoding, batch #%d, %q", w.place, w.queueIn)
-		mcw.linein <- linesToWrite{
-			data: mcw.queueIn,
-			num:  mcw.place,
+		if err := mcw.send(linesToWrite{
+			data:   mcw.queueIn,
+			values: mcw.queueVals,
+			num:    mcw.place,
+			first:  !mcw.firstSent,
+		}); err != nil {
+			return err
 		}
-		mcw.place++
+		mcw.firstSent = true
 		mcw.queueIn = make([][]string, 0, mcw.ChunkSize)
+		mcw.queueVals = nil
+		mcw.queueBytes = 0
 	}
-	if len(record) == 0 {
+	if flush {
 		//		log.Printf("in write(), requesting flush - #%d", w.place)
-		mcw.linein <- linesToWrite{
+		return mcw.send(linesToWrite{
 			num: mcw.place,
+		})
+	}
+	if value != nil && mcw.queueVals == nil {
+		// with ChunkBytes, more than ChunkSize records may be queued
+		mcw.queueVals = make([]interface{}, len(mcw.queueIn), max(len(mcw.queueIn), mcw.ChunkSize))
+	}
+	if mcw.queueVals != nil {
+		mcw.queueVals = append(mcw.queueVals, value)
+	}
+	mcw.queueIn = append(mcw.queueIn, record)
+	for _, field := range record {
+		mcw.queueBytes += len(field) + 1 // and a comma or newline
+	}
+	//		log.Printf("in write() queueing record to write - %q", w.queueIn)
+	return nil
+}
+
+// chunkFull reports whether the queued records make a chunk, must hold the
+// lock
+func (mcw *Writer) chunkFull() bool {
+	if mcw.ChunkBytes > 0 && mcw.queueVals == nil {
+		return mcw.queueBytes >= mcw.ChunkBytes
+	}
+	return len(mcw.queueIn) >= mcw.ChunkSize
+}
+
+// send hands lines to the encoding goroutines, first waiting for one of the
+// chunks in flight to be written when there are MaxInFlight of them.  Must
+// hold the lock.
+func (mcw *Writer) send(lines linesToWrite) error {
+	mcw.start()
+	if mcw.inFlight == nil && mcw.MaxInFlight > 0 {
+		mcw.inFlight = make(chan struct{}, mcw.MaxInFlight)
+	}
+	if mcw.inFlight != nil {
+		select {
+		case mcw.inFlight <- struct{}{}:
+		case <-mcw.cancel:
+			return mcw.ctx.Err()
 		}
+	}
+	select {
+	case mcw.linein <- lines:
 		mcw.place++
-	} else {
-		mcw.queueIn = append(mcw.queueIn, record)
-		//		log.Printf("in write() queueing record to write - %q", w.queueIn)
+		return nil
+	case <-mcw.cancel:
+		return mcw.ctx.Err()
 	}
-	mcw.lock.Unlock()
-	return nil
 }
 
 func (mcw *Writer) startEncoding(wg *sync.WaitGroup) {
 	defer wg.Done()
-	for records := range mcw.linein {
+	var zw *gzip.Writer
+	var zstdw *zstd.Encoder
+	switch mcw.Compression {
+	case Gzip:
+		zw = gzip.NewWriter(nil) // reset to write each block
+	case Zstd:
+		zstdw, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1)) // can't fail with these options
+		defer zstdw.Close()
+	}
+	for {
+		var records linesToWrite
+		var ok bool
+		select {
+		case records, ok = <-mcw.linein:
+		case <-mcw.cancel:
+			return
+		}
+		if !ok {
+			return
+		}
 		if len(records.data) == 0 {
-			mcw.lineout <- csvEncoded{
+			select {
+			case mcw.lineout <- csvEncoded{
 				num:  records.num,
 				data: nil, // sending a flush request
+			}:
+			case <-mcw.cancel:
+				return
 			}
 			//			log.Printf("startEncoding() - Sent flush request - #%d", records.num)
 			continue
 		}
 		//		log.Printf("startEncoding() - got batch #%d for encoding - %q", records.num, records.data)
+		if records.values != nil {
+			records.data = mcw.marshalValues(records)
+		}
 		buf := mcw.bufPool.Get().(*bytes.Buffer)
 		buf.Reset()
+		if records.first && mcw.BOM && !mcw.Encoding.singleByte() {
+			buf.WriteString("\ufeff") // transcoded like the rest
+		}
 		writer := csv.NewWriter(buf)
 		writer.Comma = mcw.Comma
 		writer.UseCRLF = mcw.UseCRLF
 		_ = writer.WriteAll(records.data) // can ignore error, writing to a buffer
-		mcw.lineout <- csvEncoded{
-			num:  records.num,
-			data: buf,
+		if mcw.Encoding != UTF8 {
+			buf = mcw.transcode(buf)
+		}
+		switch mcw.Compression {
+		case Gzip:
+			buf = mcw.compress(buf, zw)
+		case Zstd:
+			buf = mcw.compressFrame(buf, zstdw)
+		}
+		select {
+		case mcw.lineout <- csvEncoded{
+			num:   records.num,
+			data:  buf,
+			first: records.first,
+		}:
+		case <-mcw.cancel:
+			return
 		}
 		//		log.Printf("Sent %d for writing - %q", records.num, buf.String())
 	}
 }
 
+// transcode returns buf in Encoding, buf is put back in the pool
+func (mcw *Writer) transcode(buf *bytes.Buffer) *bytes.Buffer {
+	out := mcw.bufPool.Get().(*bytes.Buffer)
+	out.Reset()
+	out.Write(appendEncoded(out.AvailableBuffer(), buf.Bytes(), mcw.Encoding))
+	mcw.bufPool.Put(buf)
+	return out
+}
+
+// compress returns buf compressed as BGZF blocks, buf is put back in the pool
+func (mcw *Writer) compress(buf *bytes.Buffer, zw *gzip.Writer) *bytes.Buffer {
+	out := mcw.bufPool.Get().(*bytes.Buffer)
+	out.Reset()
+	for data := buf.Bytes(); len(data) > 0; {
+		n := len(data)
+		if n > bgzfBlockData {
+			n = bgzfBlockData
+		}
+		start := out.Len()
+		zw.Reset(out)
+		zw.Extra = []byte{'B', 'C', 2, 0, 0, 0} // the size is set below
+		_, _ = zw.Write(data[:n])               // can ignore errors, writing to a buffer
+		_ = zw.Close()
+		block := out.Bytes()[start:]
+		size := len(block) - 1
+		block[16], block[17] = byte(size), byte(size>>8)
+		data = data[n:]
+	}
+	mcw.bufPool.Put(buf)
+	return out
+}
+
+// compressFrame returns buf compressed as a zstd frame, buf is put back in the
+// pool
+func (mcw *Writer) compressFrame(buf *bytes.Buffer, zstdw *zstd.Encoder) *bytes.Buffer {
+	out := mcw.bufPool.Get().(*bytes.Buffer)
+	out.Reset()
+	out.Write(zstdw.EncodeAll(buf.Bytes(), out.AvailableBuffer()))
+	mcw.bufPool.Put(buf)
+	return out
+}
+
+// marshalValues returns the records of lines with all of the values marshaled
+func (mcw *Writer) marshalValues(lines linesToWrite) [][]string {
+	records := lines.data[:0]
+	for i, value := range lines.values {
+		if value == nil {
+			records = append(records, lines.data[i])
+			continue
+		}
+		record, err := mcw.marshal(value)
+		if err != nil {
+			mcw.setError(err)
+			continue
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
 func (mcw *Writer) writeInternal(buf *bytes.Buffer, bufferedWriter *bufio.Writer) {
 	if buf == nil {
 		//		log.Printf("Flushing underlying io.Writer")
-		err := bufferedWriter.Flush()
-		if err != nil {
-			//			log.Printf("writeInternal() caught error 1 - %v - sending", err)
-			mcw.errChan <- err
-		}
+		mcw.setError(bufferedWriter.Flush())
 		//		log.Printf("Flushed underlying io.Writer, sending notification")
-		mcw.flushOperation <- struct{}{}
-		//		log.Printf("Sent flush notification")
+		select {
+		case mcw.flushOperation <- struct{}{}:
+			//		log.Printf("Sent flush notification")
+		case <-mcw.cancel:
+		}
 		return
 	}
 	//	log.Printf("Writing underlying data - %q", buf.Bytes())
+	// bufio.Writer keeps returning the first error, including short writes
 	_, err := bufferedWriter.Write(buf.Bytes())
-	if err != nil {
-		//		log.Printf("writeInternal() caught error 2 - %v - sending", err)
-		mcw.errChan <- err
-	}
+	mcw.setError(err)
 	mcw.bufPool.Put(buf)
 }
 
+// setError records err if it's the first error
+func (mcw *Writer) setError(err error) {
+	if err == nil {
+		return
+	}
+	mcw.errLock.Lock()
+	if mcw.finalError == nil {
+		mcw.finalError = err
+	}
+	mcw.errLock.Unlock()
+}
+
+// release lets another chunk be sent once one is written
+func (mcw *Writer) release() {
+	if mcw.inFlight != nil {
+		<-mcw.inFlight
+	}
+}
+
 func (mcw *Writer) startWriting() {
 	currentPlace := 0
 	bufferedWriter := bufio.NewWriter(mcw.w)
 	queueOut := make(map[int]*bytes.Buffer)
+	written := make(map[int]bool) // chunks after currentPlace already written when Unordered
+	firstWritten := false         // with Unordered, nothing can be written before the first chunk
 Top:
 	for {
+		if written[currentPlace] {
+			delete(written, currentPlace)
+			currentPlace++
+			continue
+		}
 		buf, ok := queueOut[currentPlace]
 		if !ok {
 			break // next value isn't in the queue, move on
 		}
 		delete(queueOut, currentPlace)
 		mcw.writeInternal(buf, bufferedWriter)
+		mcw.release()
+		firstWritten = firstWritten || buf != nil // the first chunk is the first with data
 		currentPlace++
 	}
 	//	log.Printf("looking for lineout #%d", currentPlace)
@@ -214,25 +486,43 @@ Top:
 		//		log.Printf("Got line #%d from lineout", lines.num)
 		if lines.num == currentPlace {
 			mcw.writeInternal(lines.data, bufferedWriter)
+			mcw.release()
+			firstWritten = firstWritten || lines.data != nil
 			currentPlace++
+		} else if mcw.Unordered && lines.data != nil && (firstWritten || lines.first) {
+			// flush requests still wait for everything before them
+			mcw.writeInternal(lines.data, bufferedWriter)
+			mcw.release()
+			firstWritten = true
+			written[lines.num] = true
 		} else {
 			queueOut[lines.num] = lines.data
 		}
 		goto Top
 	}
-	mcw.finalError = <-mcw.errChan
 }
 
 // Flush writes any buffered data to the underlying io.Writer.
 // To check if an error occurred during the Flush, call Error.
 func (mcw *Writer) Flush() {
-	_ = mcw.write(nil)
-	<-mcw.flushOperation
+	if mcw.write(nil, nil) != nil {
+		return // cancelled
+	}
+	select {
+	case <-mcw.flushOperation:
+	case <-mcw.cancel:
+	}
 }
 
 // Error reports any error that has occurred during a previous Write or Flush.
+// Once ctx is done, Error reports ctx.Err() if nothing else went wrong.
 func (mcw *Writer) Error() error {
-	_, err := mcw.w.Write(nil)
+	mcw.errLock.Lock()
+	err := mcw.finalError
+	mcw.errLock.Unlock()
+	if err == nil {
+		err = mcw.ctx.Err()
+	}
 	return err
 }
 
@@ -6,11 +6,20 @@ package multicorecsv
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/csv"
 	"errors"
 	"fmt"
+	"io"
 	"math/rand"
+	"reflect"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
 )
 
 var writeTests = []struct {
@@ -64,6 +73,178 @@ func TestWrite(t *testing.T) {
 	}
 }
 
+func TestWriteUnordered(t *testing.T) {
+	b := &bytes.Buffer{}
+	w := NewWriterSized(b, 3)
+	w.Unordered = true
+	want := make(map[string]bool)
+	for x := 0; x < 1000; x++ {
+		record := []string{fmt.Sprint(x), "a,b"}
+		want[fmt.Sprint(x)] = true
+		if err := w.Write(record); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if x == 500 {
+			w.Flush()
+			records, err := csv.NewReader(bytes.NewReader(b.Bytes())).ReadAll()
+			if err != nil || len(records) != 501 {
+				t.Errorf("Flush wrote %d records, %v, want 501", len(records), err)
+			}
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	records, err := csv.NewReader(b).ReadAll()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	got := make(map[string]bool)
+	for _, record := range records {
+		got[record[0]] = true
+	}
+	if len(records) != len(want) || !reflect.DeepEqual(got, want) {
+		t.Errorf("Wrote %d records, %d distinct, want %d", len(records), len(got), len(want))
+	}
+}
+
+// slowField takes a while to marshal when it's 0
+type slowField int
+
+func (f slowField) MarshalCSV() (string, error) {
+	if f == 0 {
+		time.Sleep(50 * time.Millisecond)
+	}
+	return fmt.Sprint(int(f)), nil
+}
+
+func TestWriteUnorderedHeader(t *testing.T) {
+	b := &bytes.Buffer{}
+	w := NewWriterSized(b, 2)
+	w.Unordered = true
+	w.Workers = 4
+	e := NewEncoder(w)
+	for x := 0; x < 100; x++ {
+		if err := e.Encode(struct {
+			N slowField `csv:"n"`
+		}{slowField(x)}); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	records, err := csv.NewReader(b).ReadAll()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(records) != 101 || records[0][0] != "n" {
+		t.Errorf("Wrote %d records starting with %q, want 101 starting with the header", len(records), records[0])
+	}
+}
+
+func TestWriteCompressed(t *testing.T) {
+	var records [][]string
+	for x := 0; x < 5000; x++ {
+		records = append(records, []string{fmt.Sprint(x), strings.Repeat("a\n", x%50)})
+	}
+	var plain bytes.Buffer
+	w := NewWriter(&plain)
+	w.WriteAll(records)
+	w.Close()
+	zd, err := zstd.NewReader(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zd.Close()
+	for _, tt := range []struct {
+		Compression Compression
+		Sniffed     compression
+		Decompress  func(data []byte) ([]byte, error)
+	}{
+		{Gzip, bgzipped, func(data []byte) ([]byte, error) {
+			if !bytes.HasSuffix(data, bgzfEOF) {
+				return nil, errors.New("missing the BGZF end block")
+			}
+			zr, err := gzip.NewReader(bytes.NewReader(data))
+			if err != nil {
+				return nil, err
+			}
+			return io.ReadAll(zr)
+		}},
+		{Zstd, zstandard, func(data []byte) ([]byte, error) {
+			return zd.DecodeAll(data, nil)
+		}},
+	} {
+		var compressed bytes.Buffer
+		w = NewWriterSized(&compressed, 1000) // chunks bigger than a BGZF block
+		w.Compression = tt.Compression
+		if err := w.WriteAll(records); err != nil {
+			t.Errorf("Compression %d: unexpected error: %s", tt.Compression, err)
+		}
+		if err := w.Close(); err != nil {
+			t.Errorf("Compression %d: unexpected error: %s", tt.Compression, err)
+		}
+		if sniff(compressed.Bytes()) != tt.Sniffed {
+			t.Errorf("Compression %d: the output was sniffed as %d, want %d", tt.Compression, sniff(compressed.Bytes()), tt.Sniffed)
+		}
+		out, err := tt.Decompress(compressed.Bytes())
+		if err != nil || !bytes.Equal(out, plain.Bytes()) {
+			t.Errorf("Compression %d: decompressed %d bytes, %v, want %d", tt.Compression, len(out), err, plain.Len())
+		}
+		r := NewReader(bytes.NewReader(compressed.Bytes()), 50)
+		got, err := r.ReadAll()
+		r.Close()
+		if err != nil || !reflect.DeepEqual(got, records) {
+			t.Errorf("Compression %d: read back %d records, %v, want %d", tt.Compression, len(got), err, len(records))
+		}
+	}
+}
+
+func TestWriteEncoding(t *testing.T) {
+	records := [][]string{{"name", "text"}, {"1", "caf\u00e9 \u20ac"}, {"2", "\U0001f600"}}
+	for _, tt := range []struct {
+		Encoding  Encoding
+		Unordered bool
+		Output    string
+	}{
+		{Encoding: UTF8, Output: "\ufeffname,text\n1,caf\u00e9 \u20ac\n2,\U0001f600\n"},
+		{Encoding: UTF16LE, Output: "\xff\xfen\x00a\x00m\x00e\x00,\x00t\x00e\x00x\x00t\x00\n\x00" +
+			"1\x00,\x00c\x00a\x00f\x00\xe9\x00 \x00\xac\x20\n\x00" +
+			"2\x00,\x00\x3d\xd8\x00\xde\n\x00"},
+		{Encoding: Windows1252, Output: "name,text\n1,caf\xe9 \x80\n2,?\n"},
+		{Encoding: Latin1, Unordered: true, Output: "name,text\n1,caf\xe9 ?\n2,?\n"},
+	} {
+		b := &bytes.Buffer{}
+		w := NewWriterSized(b, 1)
+		w.Encoding = tt.Encoding
+		w.Unordered = tt.Unordered
+		w.BOM = true
+		if err := w.WriteAll(records); err != nil {
+			t.Errorf("Unexpected error: %s", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Errorf("Unexpected error: %s", err)
+		}
+		if b.String() != tt.Output {
+			t.Errorf("Encoding %d: out=%q want %q", tt.Encoding, b.String(), tt.Output)
+		}
+	}
+
+	// the BOM comes first even when the chunks are written out of order
+	b := &bytes.Buffer{}
+	w := NewWriterSized(b, 1)
+	w.Unordered = true
+	w.BOM = true
+	for x := 0; x < 100; x++ {
+		w.Write([]string{fmt.Sprint(x)})
+	}
+	w.Close()
+	if !bytes.HasPrefix(b.Bytes(), utf8BOM) || bytes.Count(b.Bytes(), utf8BOM) != 1 {
+		t.Errorf("Unordered output doesn't start with the only BOM: %q", b.String())
+	}
+}
+
 type errorWriter struct{}
 
 func (e errorWriter) Write(b []byte) (int, error) {
@@ -92,6 +273,83 @@ func TestError(t *testing.T) {
 	}
 }
 
+type shortWriter struct{}
+
+func (s shortWriter) Write(b []byte) (int, error) {
+	return len(b) / 2, nil
+}
+
+func TestErrorPropagation(t *testing.T) {
+	tests := []struct {
+		w    io.Writer
+		want string
+	}{
+		{w: errorWriter{}, want: "Test"},
+		{w: shortWriter{}, want: io.ErrShortWrite.Error()},
+	}
+	for _, tt := range tests {
+		f := NewWriterSized(tt.w, 1)
+		err := f.WriteAll(sliceData[:10])
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("%T: WriteAll returned %v, want %s", tt.w, err, tt.want)
+		}
+		if got := f.Write(sliceData[0]); got != err {
+			t.Errorf("%T: Write after error returned %v, want %v", tt.w, got, err)
+		}
+		f.Flush()
+		if got := f.Error(); got != err {
+			t.Errorf("%T: Error after Flush returned %v, want %v", tt.w, got, err)
+		}
+		if got := f.Close(); got != err {
+			t.Errorf("%T: Close returned %v, want %v", tt.w, got, err)
+		}
+	}
+	f := NewWriter(&bytes.Buffer{})
+	f.Close()
+	if err := f.Write(sliceData[0]); err != ErrWriterClosed {
+		t.Errorf("Write after Close returned %v, want %v", err, ErrWriterClosed)
+	}
+}
+
+func TestWriteContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	f := NewWriterContext(ctx, &infiniteWriter{}, 1)
+	for _, line := range sliceData[:10] {
+		if err := f.Write(line); err != nil {
+			t.Errorf("Unexpected error: %s\n", err)
+		}
+	}
+	cancel()
+	if err := f.Write(sliceData[0]); err != context.Canceled {
+		t.Errorf("Write after cancel returned %v, want %v", err, context.Canceled)
+	}
+	f.Flush()
+	if err := f.Close(); err != context.Canceled {
+		t.Errorf("Close after cancel returned %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestWriteContextStops(t *testing.T) {
+	before := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	f := NewWriterContext(ctx, &infiniteWriter{}, 1)
+	for _, line := range sliceData[:10] {
+		if err := f.Write(line); err != nil {
+			t.Errorf("Unexpected error: %s\n", err)
+		}
+	}
+	cancel()
+	// the goroutines are stopped by cancel, not by Close
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("%d goroutines left running after cancel, want %d", n, before)
+	}
+	f.Close()
+}
+
 func benchmarkWrite(b *testing.B, chunkSize int) {
 	ir := &infiniteWriter{}
 	writer := NewWriterSized(ir, chunkSize)